@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// generationMeta is written by SerializeWithKids next to the root of every
+// generation, so that listing generations doesn't need to walk their trees.
+type generationMeta struct {
+	Created time.Time `json:"created"`
+	Entries int       `json:"entries"`
+	Height  int       `json:"height"`
+}
+
+func metaKey(gen int) string { return fmt.Sprintf("meta:%d", gen) }
+
+// generationKeys are the keys that make up generation gen, besides its nodes.
+// The root goes first: deleting it first never leaves a dangling root behind.
+func generationKeys(gen int) []string {
+	return []string{rootKey(gen), configKey(gen), metaKey(gen)}
+}
+
+// Generation describes a stored generation.
+type Generation struct {
+	Gen     int       `json:"gen"`
+	Root    Hash      `json:"root"`
+	Entries int       `json:"entries"`
+	Height  int       `json:"height"`
+	Created time.Time `json:"created"`
+}
+
+var ErrGenerationNotFound = errors.New("generation not found")
+var ErrMetaMissing = errors.New("generation metadata not found")
+
+// Catalog lists and drops the generations stored in a KV.
+type Catalog struct {
+	kv KV
+}
+
+func NewCatalog(kv KV) *Catalog { return &Catalog{kv: kv} }
+
+// List returns every stored generation in ascending order.
+func (c *Catalog) List() ([]Generation, error) {
+	roots, err := storedRoots(c.kv)
+	if err != nil {
+		return nil, err
+	}
+	out := []Generation{}
+	for gen, root := range roots {
+		g, err := c.describe(gen, root)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+	}
+	slices.SortFunc(out, func(a, b Generation) int { return a.Gen - b.Gen })
+	return out, nil
+}
+
+// Get describes generation gen.
+func (c *Catalog) Get(gen int) (Generation, error) {
+	value, found, err := c.kv.Get([]byte(rootKey(gen)))
+	if err != nil {
+		return Generation{}, err
+	}
+	if !found {
+		return Generation{}, fmt.Errorf("%w: %d", ErrGenerationNotFound, gen)
+	}
+	root, err := HashFromBytes(value)
+	if err != nil {
+		return Generation{}, fmt.Errorf("generation %d: %w", gen, err)
+	}
+	return c.describe(gen, root)
+}
+
+// describe reads the metadata of generation gen.
+func (c *Catalog) describe(gen int, root Hash) (Generation, error) {
+	g := Generation{Gen: gen, Root: root}
+	data, found, err := c.kv.Get([]byte(metaKey(gen)))
+	if err != nil {
+		return g, err
+	}
+	if !found {
+		return g, fmt.Errorf("generation %d: %w", gen, ErrMetaMissing)
+	}
+	var meta generationMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return g, fmt.Errorf("generation %d: %w", gen, err)
+	}
+	g.Created, g.Entries, g.Height = meta.Created, meta.Entries, meta.Height
+	return g, nil
+}
+
+// Drop forgets generation gen. Its nodes stay in the store until GC deletes
+// the ones no other generation refers to.
+func (c *Catalog) Drop(gen int) error {
+	_, found, err := c.kv.Get([]byte(rootKey(gen)))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %d", ErrGenerationNotFound, gen)
+	}
+	for _, key := range generationKeys(gen) {
+		if err := c.kv.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetentionPolicy decides which generations to keep: the KeepLast newest
+// ones, plus the newest one of each of the KeepDaily days up to now. Days are
+// UTC calendar days; generations without a creation time only count for
+// KeepLast.
+//
+//	RetentionPolicy{KeepLast: 5, KeepDaily: 30}
+type RetentionPolicy struct {
+	KeepLast  int `json:"keep_last"`
+	KeepDaily int `json:"keep_daily"`
+}
+
+// Keep returns the generations of gens the policy retains, in ascending order.
+func (p RetentionPolicy) Keep(gens []Generation, now time.Time) []int {
+	sorted := slices.Clone(gens)
+	slices.SortFunc(sorted, func(a, b Generation) int { return b.Gen - a.Gen })
+	keep := map[int]bool{}
+	for i, g := range sorted {
+		if i < p.KeepLast {
+			keep[g.Gen] = true
+		}
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	oldest := today.AddDate(0, 0, 1-p.KeepDaily)
+	days := map[time.Time]bool{}
+	for _, g := range sorted {
+		day := g.Created.UTC().Truncate(24 * time.Hour)
+		if g.Created.IsZero() || day.Before(oldest) || day.After(today) || days[day] {
+			continue
+		}
+		days[day] = true
+		keep[g.Gen] = true
+	}
+	out := []int{}
+	for gen := range keep {
+		out = append(out, gen)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// ApplyRetention drops the generations policy doesn't keep and collects their
+// nodes with GC. A policy that would drop every generation is refused.
+func (c *Catalog) ApplyRetention(policy RetentionPolicy, now time.Time, dryRun bool) (*GCReport, error) {
+	gens, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	keep := policy.Keep(gens, now)
+	if len(keep) == 0 && len(gens) > 0 {
+		return nil, fmt.Errorf("retention policy %+v keeps no generation", policy)
+	}
+	return GC(c.kv, keep, dryRun)
+}
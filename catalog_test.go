@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	before := time.Now()
+	for gen, n := range []int{10, 60, 150} {
+		require.Nil(t, NewTree(generate1(n), nil).SerializeWithKids(gen+1, kv))
+	}
+	catalog := NewCatalog(kv)
+	gens, err := catalog.List()
+	require.Nil(t, err)
+	require.Len(t, gens, 3)
+	for i, n := range []int{10, 60, 150} {
+		tree := NewTree(generate1(n), nil)
+		g := gens[i]
+		require.Equal(t, i+1, g.Gen)
+		require.Equal(t, tree.Root().merkleHash, g.Root)
+		require.Equal(t, n, g.Entries)
+		require.Equal(t, tree.Height(), g.Height)
+		require.False(t, g.Created.Before(before.Add(-time.Second)))
+	}
+
+	// a generation without metadata is an error, not a walk of its tree
+	meta, _, err := kv.Get([]byte(metaKey(2)))
+	require.Nil(t, err)
+	require.Nil(t, kv.Delete([]byte(metaKey(2))))
+	_, err = catalog.Get(2)
+	require.ErrorIs(t, err, ErrMetaMissing)
+	_, err = catalog.List()
+	require.ErrorIs(t, err, ErrMetaMissing)
+	require.Nil(t, kv.Set([]byte(metaKey(2)), meta))
+
+	require.Nil(t, catalog.Drop(1))
+	require.ErrorIs(t, catalog.Drop(1), ErrGenerationNotFound)
+	_, err = catalog.Get(1)
+	require.ErrorIs(t, err, ErrGenerationNotFound)
+	gens, err = catalog.List()
+	require.Nil(t, err)
+	require.Len(t, gens, 2)
+
+	report, err := Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%v", report.Problems)
+	require.NotEmpty(t, report.Orphans)
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Date(2024, 3, 31, 15, 0, 0, 0, time.UTC)
+	var gens []Generation
+	// four generations a day for 40 days, then two without a creation time
+	for i := range 160 {
+		created := now.Add(-time.Duration(159-i) * 6 * time.Hour)
+		gens = append(gens, Generation{Gen: i + 1, Created: created})
+	}
+	gens = append(gens, Generation{Gen: 161}, Generation{Gen: 162})
+
+	keep := RetentionPolicy{KeepLast: 3}.Keep(gens, now)
+	require.Equal(t, []int{160, 161, 162}, keep)
+
+	keep = RetentionPolicy{KeepDaily: 30}.Keep(gens, now)
+	require.Len(t, keep, 30)
+	require.Equal(t, 160, keep[len(keep)-1])
+	days := map[string]bool{}
+	for _, gen := range keep {
+		created := gens[gen-1].Created
+		require.False(t, created.Before(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)))
+		days[created.Format(time.DateOnly)] = true
+		// the newest of its day
+		require.NotEqual(t, created.Format(time.DateOnly), gens[gen].Created.Format(time.DateOnly))
+	}
+	require.Len(t, days, 30)
+
+	both := RetentionPolicy{KeepLast: 5, KeepDaily: 30}.Keep(gens, now)
+	require.Len(t, both, 34)
+	require.Empty(t, RetentionPolicy{}.Keep(gens, now))
+}
+
+func TestApplyRetention(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	now := time.Date(2024, 3, 31, 15, 0, 0, 0, time.UTC)
+	tree := NewTree(generate1(50), nil)
+	for gen := 1; gen <= 6; gen++ {
+		tree.Put([]byte("gen"), []byte{byte(gen)})
+		require.Nil(t, tree.SerializeWithKids(gen, kv))
+		// one generation every 12 hours
+		meta, err := json.Marshal(generationMeta{Created: now.Add(-time.Duration(6-gen) * 12 * time.Hour), Entries: tree.Len(), Height: tree.Height()})
+		require.Nil(t, err)
+		require.Nil(t, kv.Set([]byte(metaKey(gen)), meta))
+	}
+	catalog := NewCatalog(kv)
+	_, err := catalog.ApplyRetention(RetentionPolicy{}, now, false)
+	require.Error(t, err)
+
+	policy := RetentionPolicy{KeepLast: 1, KeepDaily: 2}
+	dry, err := catalog.ApplyRetention(policy, now, true)
+	require.Nil(t, err)
+	require.Equal(t, []int{4, 6}, dry.Kept)
+	require.Equal(t, []int{1, 2, 3, 5}, dry.Dropped)
+	gens, err := catalog.List()
+	require.Nil(t, err)
+	require.Len(t, gens, 6)
+
+	report, err := catalog.ApplyRetention(policy, now, false)
+	require.Nil(t, err)
+	require.Positive(t, report.Swept)
+	gens, err = catalog.List()
+	require.Nil(t, err)
+	require.Equal(t, []int{4, 6}, []int{gens[0].Gen, gens[1].Gen})
+	fsck, err := Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, fsck.OK(), "%v", fsck.Problems)
+	require.Empty(t, fsck.Orphans)
+}
+
+func TestCatalogCommands(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewKVFileAt(dir)
+	require.Nil(t, NewTree(generate1(20), nil).SerializeWithKids(1, kv))
+	require.Nil(t, NewTree(generate1(30), nil).SerializeWithKids(2, kv))
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, run([]string{"list", "-dir", dir}, &stdout, &stderr), stderr.String())
+	var gens []Generation
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &gens))
+	require.Len(t, gens, 2)
+	require.Equal(t, 30, gens[1].Entries)
+
+	require.Equal(t, 0, run([]string{"drop", "-dir", dir, "-gen", "1"}, &stdout, &stderr), stderr.String())
+	require.Equal(t, 2, run([]string{"drop", "-dir", dir, "-gen", "1"}, &stdout, &stderr))
+
+	stdout.Reset()
+	require.Equal(t, 0, run([]string{"retain", "-dir", dir, "-last", "1"}, &stdout, &stderr), stderr.String())
+	var report GCReport
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.Equal(t, []int{2}, report.Kept)
+	require.Positive(t, report.Swept)
+	require.Equal(t, 2, run([]string{"retain", "-dir", dir}, &stdout, &stderr))
+}
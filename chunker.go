@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ChunkStats describes the chunk that a candidate node would close.
+type ChunkStats struct {
+	Entries int // nodes in the chunk so far, the candidate included
+	Bytes   int // their total EncodedSize
+}
+
+// Chunker decides which nodes end a chunk and get promoted to the next level.
+// The decision may only depend on the arguments, otherwise the shape of the
+// tree would depend on the order of edits.
+type Chunker interface {
+	Name() string
+	IsBoundary(hash Hash, chunk ChunkStats) bool
+}
+
+var DefaultChunker Chunker = ThresholdChunker{Threshold: BoundaryThreshold}
+
+// ThresholdChunker ends a chunk whenever the hash prefix is below Threshold.
+// The chunk size has no influence, so sizes are geometrically distributed:
+// most chunks are small, and a few are very long.
+type ThresholdChunker struct {
+	Threshold uint32
+}
+
+var _ Chunker = ThresholdChunker{}
+
+// MaxAverage is the largest average chunk size that chunkers can draw from
+// the 32 bit hash prefix: beyond it, no hash would ever end a chunk.
+const MaxAverage = 1 << 32
+
+func checkAverage(average int) error {
+	if average < 1 || uint64(average) > MaxAverage {
+		return fmt.Errorf("average chunk size %d is not in [1, %d]", average, uint64(MaxAverage))
+	}
+	return nil
+}
+
+// FanoutChunker returns a ThresholdChunker with the given average chunk size.
+func FanoutChunker(average int) ThresholdChunker {
+	mustNil(checkAverage(average))
+	return ThresholdChunker{Threshold: uint32(min(math.MaxUint32, (1<<32)/uint64(average)))}
+}
+
+func (c ThresholdChunker) Name() string { return fmt.Sprintf("threshold:%d", c.Threshold) }
+
+func (c ThresholdChunker) IsBoundary(hash Hash, chunk ChunkStats) bool {
+	return HashPrefix(hash) < c.Threshold
+}
+
+// CDFChunker makes a boundary more likely the longer a chunk grows, similar to
+// Dolt. Chunk sizes follow a Weibull distribution with mean Average and shape
+// K: the larger K is, the more chunk sizes concentrate around the average.
+type CDFChunker struct {
+	Average int
+	K       float64
+}
+
+var _ Chunker = CDFChunker{}
+
+func NewCDFChunker(average int) CDFChunker {
+	mustNil(checkAverage(average))
+	return CDFChunker{Average: average, K: 4}
+}
+
+func (c CDFChunker) Name() string { return fmt.Sprintf("cdf:%d:%g", c.Average, c.K) }
+
+// IsBoundary ends the chunk with the probability that a chunk of this size
+// ends here, given that it did not end before: 1 - S(n)/S(n-1), where S is the
+// survival function of the Weibull distribution.
+func (c CDFChunker) IsBoundary(hash Hash, chunk ChunkStats) bool {
+	scale := float64(c.Average) / math.Gamma(1+1/c.K)
+	before := math.Pow(float64(chunk.Entries-1)/scale, c.K)
+	here := math.Pow(float64(chunk.Entries)/scale, c.K)
+	p := 1 - math.Exp(before-here)
+	return float64(HashPrefix(hash)) < p*(1<<32)
+}
+
+// LimitChunker bounds the chunks produced by another chunker. A chunk never
+// ends before it holds MinEntries nodes and MinBytes bytes, and always ends at
+// the first node that brings it to MaxEntries nodes or MaxBytes bytes, so a
+// chunk can exceed MaxBytes by at most one node. Maximums win over minimums,
+// and zero disables a limit. Only the tail may end a chunk that is too small.
+type LimitChunker struct {
+	Chunker
+	MinEntries int
+	MaxEntries int
+	MinBytes   int
+	MaxBytes   int
+}
+
+var _ Chunker = LimitChunker{}
+
+func NewLimitChunker(chunker Chunker, minEntries, maxEntries, minBytes, maxBytes int) LimitChunker {
+	mustTrue(maxEntries == 0 || minEntries <= maxEntries, "min entries %d exceed max entries %d", minEntries, maxEntries)
+	mustTrue(maxBytes == 0 || minBytes <= maxBytes, "min bytes %d exceed max bytes %d", minBytes, maxBytes)
+	return LimitChunker{
+		Chunker:    chunker,
+		MinEntries: minEntries,
+		MaxEntries: maxEntries,
+		MinBytes:   minBytes,
+		MaxBytes:   maxBytes,
+	}
+}
+
+func (c LimitChunker) Name() string {
+	return fmt.Sprintf("limit:%d:%d:%d:%d:%s", c.MinEntries, c.MaxEntries, c.MinBytes, c.MaxBytes, c.Chunker.Name())
+}
+
+func (c LimitChunker) IsBoundary(hash Hash, chunk ChunkStats) bool {
+	if c.MaxEntries > 0 && chunk.Entries >= c.MaxEntries {
+		return true
+	}
+	if c.MaxBytes > 0 && chunk.Bytes >= c.MaxBytes {
+		return true
+	}
+	if chunk.Entries < c.MinEntries || chunk.Bytes < c.MinBytes {
+		return false
+	}
+	return c.Chunker.IsBoundary(hash, chunk)
+}
+
+// ParseChunker returns the chunker whose Name is name.
+func ParseChunker(name string) (Chunker, error) {
+	kind, args, _ := strings.Cut(name, ":")
+	switch kind {
+	case "threshold":
+		threshold, err := strconv.ParseUint(args, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("chunker %q: %w", name, err)
+		}
+		return ThresholdChunker{Threshold: uint32(threshold)}, nil
+	case "cdf":
+		average, k, _ := strings.Cut(args, ":")
+		var c CDFChunker
+		var err error
+		if c.Average, err = strconv.Atoi(average); err != nil {
+			return nil, fmt.Errorf("chunker %q: %w", name, err)
+		}
+		if c.K, err = strconv.ParseFloat(k, 64); err != nil {
+			return nil, fmt.Errorf("chunker %q: %w", name, err)
+		}
+		if err := checkAverage(c.Average); err != nil {
+			return nil, fmt.Errorf("chunker %q: %w", name, err)
+		}
+		if c.K <= 0 {
+			return nil, fmt.Errorf("chunker %q: bad parameters", name)
+		}
+		return c, nil
+	case "limit":
+		parts := strings.SplitN(args, ":", 5)
+		if len(parts) != 5 {
+			return nil, fmt.Errorf("chunker %q: expected 4 limits and a chunker", name)
+		}
+		var limits [4]int
+		for i := range limits {
+			n, err := strconv.Atoi(parts[i])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("chunker %q: bad limit %q", name, parts[i])
+			}
+			limits[i] = n
+		}
+		inner, err := ParseChunker(parts[4])
+		if err != nil {
+			return nil, err
+		}
+		return LimitChunker{Chunker: inner, MinEntries: limits[0], MaxEntries: limits[1], MinBytes: limits[2], MaxBytes: limits[3]}, nil
+	default:
+		return nil, fmt.Errorf("unknown chunker: %q", name)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func withChunker(chunker Chunker) *TreeConfig {
+	return &TreeConfig{Chunker: chunker, Hasher: DefaultHasher}
+}
+
+func chunkSizes(level *Level) (sizes []int) {
+	size := 0
+	for _, n := range level.AsList() {
+		size++
+		if n.IsBoundary() {
+			sizes = append(sizes, size)
+			size = 0
+		}
+	}
+	return sizes
+}
+
+func TestChunkersHistoryIndependent(t *testing.T) {
+	for _, chunker := range []Chunker{DefaultChunker, FanoutChunker(3), NewCDFChunker(4)} {
+		rnd := rand.New(rand.NewPCG(7, 8))
+		tree := NewTree(nil, withChunker(chunker))
+		want := map[string]string{}
+		for range 300 {
+			batch := NewBatch()
+			for range rnd.IntN(5) + 1 {
+				key := strconv.Itoa(rnd.IntN(200))
+				if rnd.IntN(3) == 0 {
+					batch.Delete([]byte(key))
+					delete(want, key)
+				} else {
+					value := fmt.Sprintf("value %d", rnd.IntN(3))
+					batch.Put([]byte(key), []byte(value))
+					want[key] = value
+				}
+			}
+			tree.Apply(batch)
+			requireSameTreeWith(t, withChunker(chunker), want, tree)
+		}
+	}
+}
+
+func TestChunkerFanout(t *testing.T) {
+	messages := generateSorted(3000)
+	narrow := NewTree(messages, withChunker(FanoutChunker(4)))
+	wide := NewTree(messages, withChunker(FanoutChunker(64)))
+	require.Greater(t, narrow.Height(), wide.Height())
+	require.NotEqual(t, narrow.Root().merkleHash, wide.Root().merkleHash)
+	require.Equal(t, NewTree(messages, nil).Root().merkleHash, NewTree(messages, withChunker(FanoutChunker(AverageBucketSize))).Root().merkleHash)
+
+	require.Equal(t, uint32(1), FanoutChunker(MaxAverage).Threshold)
+	for _, average := range []int{0, MaxAverage + 1} {
+		require.Panics(t, func() { FanoutChunker(average) })
+		require.Panics(t, func() { NewCDFChunker(average) })
+	}
+}
+
+func TestChunkerCDF(t *testing.T) {
+	messages := generateSorted(5000)
+	threshold := chunkSizes(NewTree(messages, withChunker(FanoutChunker(10))).levels[0])
+	cdf := chunkSizes(NewTree(messages, withChunker(NewCDFChunker(10))).levels[0])
+
+	mean := func(xs []int) float64 {
+		sum := 0
+		for _, x := range xs {
+			sum += x
+		}
+		return float64(sum) / float64(len(xs))
+	}
+	require.InDelta(t, 10, mean(cdf), 1.5)
+	require.InDelta(t, 10, mean(threshold), 1.5)
+	require.Less(t, slices.Max(cdf), slices.Max(threshold))
+	require.Less(t, slices.Max(cdf), 25)
+}
+
+func TestLimitChunker(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(9, 10))
+	messages := []*Message{}
+	for i := range 1000 {
+		size := rnd.IntN(50)
+		if rnd.IntN(20) == 0 {
+			size = 5000 + rnd.IntN(5000)
+		}
+		messages = append(messages, NewMessage([]byte(fmt.Sprintf("%05d", i)), []byte(strings.Repeat("x", size))))
+	}
+	chunker := NewLimitChunker(DefaultChunker, 3, 16, 200, 4096)
+	tree := NewTree(messages, withChunker(chunker))
+	for _, level := range tree.levels[:tree.Height()-1] {
+		var chunk ChunkStats
+		for _, n := range level.AsList() {
+			chunk.Entries++
+			chunk.Bytes += n.EncodedSize()
+			if !n.IsBoundary() {
+				require.Less(t, chunk.Entries, 16)
+				require.Less(t, chunk.Bytes, 4096)
+				continue
+			}
+			if !n.isTail && chunk.Bytes < 4096 {
+				require.GreaterOrEqual(t, chunk.Entries, 3)
+				require.GreaterOrEqual(t, chunk.Bytes, 200)
+			}
+			require.LessOrEqual(t, chunk.Entries, 16)
+			require.Less(t, chunk.Bytes-n.EncodedSize(), 4096)
+			chunk = ChunkStats{}
+		}
+	}
+
+	want := mapOf(messages)
+	for range 50 {
+		batch := NewBatch()
+		for range rnd.IntN(10) + 1 {
+			key := fmt.Sprintf("%05d", rnd.IntN(1100))
+			if rnd.IntN(3) == 0 {
+				batch.Delete([]byte(key))
+				delete(want, key)
+			} else {
+				value := strings.Repeat("y", rnd.IntN(3000))
+				batch.Put([]byte(key), []byte(value))
+				want[key] = value
+			}
+		}
+		tree.Apply(batch)
+		requireSameTreeWith(t, withChunker(chunker), want, tree)
+	}
+}
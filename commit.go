@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Commit records a version of a dataset: the root of its tree and the commits
+// it was derived from. Commits are content addressed like nodes, so a commit
+// hash pins the whole history behind it.
+type Commit struct {
+	Root    Hash      `json:"root"`
+	Parents []Hash    `json:"parents"`
+	Author  string    `json:"author"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// LogEntry is a commit along with its hash.
+type LogEntry struct {
+	Hash Hash `json:"hash"`
+	*Commit
+}
+
+// CommitPrefix starts the KV keys of commits. Commits are kept apart from
+// nodes so that they can't be mistaken for one.
+const CommitPrefix = "commit:"
+
+func commitKey(hash Hash) []byte { return append([]byte(CommitPrefix), hash[:]...) }
+
+var ErrCommitFormat = errors.New("invalid commit")
+
+// History reads and writes the commits stored in a KV.
+type History struct {
+	kv KV
+}
+
+func NewHistory(kv KV) *History { return &History{kv: kv} }
+
+func encodeCommit(c *Commit) ([]byte, error) {
+	normalized := *c
+	normalized.Time = c.Time.UTC()
+	if normalized.Parents == nil {
+		normalized.Parents = []Hash{}
+	}
+	return json.Marshal(&normalized)
+}
+
+// Write stores c and returns its hash. The root and the parents must already
+// be stored.
+func (h *History) Write(c *Commit) (Hash, error) {
+	_, found, err := h.kv.Get(EncodeKeyWithKids(c.Root))
+	if err != nil {
+		return Hash{}, err
+	}
+	if !found {
+		return Hash{}, fmt.Errorf("commit root %s: %w", c.Root, ErrNodeMissing)
+	}
+	for _, parent := range c.Parents {
+		found, err := h.IsCommit(parent)
+		if err != nil {
+			return Hash{}, err
+		}
+		if !found {
+			return Hash{}, fmt.Errorf("%w: parent %s not found", ErrCommitFormat, parent)
+		}
+	}
+	hasher, err := loadHasher(h.kv)
+	if err != nil {
+		return Hash{}, err
+	}
+	data, err := encodeCommit(c)
+	if err != nil {
+		return Hash{}, err
+	}
+	var hash Hash
+	copy(hash[:], hasher.Sum(data))
+	return hash, h.kv.Set(commitKey(hash), data)
+}
+
+// Get reads the commit stored under hash and checks that it hashes to it.
+func (h *History) Get(hash Hash) (*Commit, error) {
+	data, found, err := h.kv.Get(commitKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: commit %s not found", ErrCommitFormat, hash)
+	}
+	hasher, err := loadHasher(h.kv)
+	if err != nil {
+		return nil, err
+	}
+	var computed Hash
+	copy(computed[:], hasher.Sum(data))
+	if computed != hash {
+		return nil, fmt.Errorf("%w: commit %s hashes to %s", ErrCommitFormat, hash, computed)
+	}
+	c := &Commit{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%w: commit %s: %v", ErrCommitFormat, hash, err)
+	}
+	return c, nil
+}
+
+// IsCommit tells whether hash names a stored commit rather than a tree.
+func (h *History) IsCommit(hash Hash) (bool, error) {
+	_, found, err := h.kv.Get(commitKey(hash))
+	return found, err
+}
+
+// treeOf returns the root of the commit hash names, or hash itself when it
+// names a tree.
+func (h *History) treeOf(hash Hash) (Hash, error) {
+	isCommit, err := h.IsCommit(hash)
+	if err != nil || !isCommit {
+		return hash, err
+	}
+	c, err := h.Get(hash)
+	if err != nil {
+		return Hash{}, err
+	}
+	return c.Root, nil
+}
+
+// Commit stores tree and a commit of it on top of the commit ref name points
+// at, then moves the ref to the new commit. merged are further parents, such
+// as the other side of a merge. The ref is created when it doesn't exist and
+// fails with ErrRefConflict when another writer moved it meanwhile. A ref
+// that points at a tree, as written by SerializeRef, first gets that tree
+// wrapped in a root commit, so that it stays in the history.
+func (h *History) Commit(name string, tree *Tree, author string, message string, merged ...Hash) (Hash, error) {
+	refs := NewRefs(h.kv)
+	old, err := refs.Get(name)
+	if err != nil && !errors.Is(err, ErrRefNotFound) {
+		return Hash{}, err
+	}
+	now := time.Now().UTC()
+	var parents []Hash
+	if !old.IsZero() {
+		isCommit, err := h.IsCommit(old)
+		if err != nil {
+			return Hash{}, err
+		}
+		parent := old
+		if !isCommit {
+			parent, err = h.Write(&Commit{Root: old, Author: author, Time: now, Message: fmt.Sprintf("%s before its first commit", name)})
+			if err != nil {
+				return Hash{}, err
+			}
+		}
+		parents = append(parents, parent)
+	}
+	parents = append(parents, merged...)
+	root, err := tree.writeRoot(h.kv)
+	if err != nil {
+		return Hash{}, err
+	}
+	hash, err := h.Write(&Commit{Root: root, Parents: parents, Author: author, Time: now, Message: message})
+	if err != nil {
+		return Hash{}, err
+	}
+	return hash, refs.Update(name, old, hash)
+}
+
+// Log returns the commits reachable from the ref or commit hash name, newest
+// first. A commit always comes after the commits derived from it, whatever
+// their times; other ties are broken by hash.
+func (h *History) Log(name string) ([]LogEntry, error) {
+	head, err := h.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	ancestors, err := h.ancestors(head)
+	if err != nil {
+		return nil, err
+	}
+	children := map[Hash]int{}
+	for _, c := range ancestors {
+		for _, parent := range c.Parents {
+			children[parent]++
+		}
+	}
+	log := make([]LogEntry, 0, len(ancestors))
+	ready := []LogEntry{{Hash: head, Commit: ancestors[head]}}
+	for len(ready) > 0 {
+		newest := 0
+		for i, entry := range ready {
+			if newerEntry(entry, ready[newest]) {
+				newest = i
+			}
+		}
+		entry := ready[newest]
+		ready = slices.Delete(ready, newest, newest+1)
+		log = append(log, entry)
+		for _, parent := range entry.Parents {
+			if children[parent]--; children[parent] == 0 {
+				ready = append(ready, LogEntry{Hash: parent, Commit: ancestors[parent]})
+			}
+		}
+	}
+	return log, nil
+}
+
+// newerEntry orders commits by time, newest first, then by hash.
+func newerEntry(a LogEntry, b LogEntry) bool {
+	if !a.Time.Equal(b.Time) {
+		return a.Time.After(b.Time)
+	}
+	return bytes.Compare(a.Hash[:], b.Hash[:]) < 0
+}
+
+// resolve returns the commit a ref points at. A hex commit hash resolves to
+// itself.
+func (h *History) resolve(name string) (Hash, error) {
+	hash, err := ParseHash(name)
+	if err != nil {
+		ref, err := NewRefs(h.kv).Resolve(name)
+		if err != nil {
+			return Hash{}, err
+		}
+		hash = ref.Root
+	}
+	isCommit, err := h.IsCommit(hash)
+	if err != nil {
+		return Hash{}, err
+	}
+	if !isCommit {
+		return Hash{}, fmt.Errorf("%w: %s doesn't point at a commit", ErrCommitFormat, name)
+	}
+	return hash, nil
+}
+
+// ancestors returns head and every commit behind it.
+func (h *History) ancestors(head Hash) (map[Hash]*Commit, error) {
+	seen := map[Hash]*Commit{}
+	queue := []Hash{head}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[hash]; ok {
+			continue
+		}
+		c, err := h.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+		seen[hash] = c
+		queue = append(queue, c.Parents...)
+	}
+	return seen, nil
+}
+
+// CommonAncestor returns the best common ancestor of the commits a and b,
+// which are refs or commit hashes: a common ancestor that no other common
+// ancestor descends from. When there are several, as after criss-cross
+// merges, the newest one is returned. It returns false when the histories are
+// unrelated.
+func (h *History) CommonAncestor(a string, b string) (Hash, bool, error) {
+	ha, err := h.resolve(a)
+	if err != nil {
+		return Hash{}, false, err
+	}
+	hb, err := h.resolve(b)
+	if err != nil {
+		return Hash{}, false, err
+	}
+	ancestorsA, err := h.ancestors(ha)
+	if err != nil {
+		return Hash{}, false, err
+	}
+	ancestorsB, err := h.ancestors(hb)
+	if err != nil {
+		return Hash{}, false, err
+	}
+	common := map[Hash]*Commit{}
+	for hash, c := range ancestorsA {
+		if _, ok := ancestorsB[hash]; ok {
+			common[hash] = c
+		}
+	}
+	// drop the common ancestors that are behind another common ancestor
+	redundant := map[Hash]bool{}
+	for _, c := range common {
+		queue := slices.Clone(c.Parents)
+		for len(queue) > 0 {
+			hash := queue[0]
+			queue = queue[1:]
+			if redundant[hash] {
+				continue
+			}
+			redundant[hash] = true
+			queue = append(queue, common[hash].Parents...)
+		}
+	}
+	var best *LogEntry
+	for hash, c := range common {
+		entry := LogEntry{Hash: hash, Commit: c}
+		if !redundant[hash] && (best == nil || newerEntry(entry, *best)) {
+			best = &entry
+		}
+	}
+	if best == nil {
+		return Hash{}, false, nil
+	}
+	return best.Hash, true, nil
+}
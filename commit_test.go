@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	history := NewHistory(kv)
+	refs := NewRefs(kv)
+	tree := NewTree(generate1(50), nil)
+	branch, feature := BranchRef("main"), BranchRef("feature")
+
+	c1, err := history.Commit(branch, tree, "alice", "first")
+	require.Nil(t, err)
+	tree.Put([]byte("main"), []byte("1"))
+	c2, err := history.Commit(branch, tree, "alice", "second")
+	require.Nil(t, err)
+	require.Nil(t, refs.Update(feature, Hash{}, c1))
+	side := NewTree(generate1(50), nil)
+	side.Put([]byte("feature"), []byte("1"))
+	c3, err := history.Commit(feature, side, "bob", "side")
+	require.Nil(t, err)
+
+	base, found, err := history.CommonAncestor("main", "feature")
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, c1, base)
+
+	tree.Put([]byte("feature"), []byte("1"))
+	c4, err := history.Commit(branch, tree, "alice", "merge", c3)
+	require.Nil(t, err)
+	base, found, err = history.CommonAncestor("main", c3.String())
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, c3, base)
+
+	log, err := history.Log("main")
+	require.Nil(t, err)
+	require.Len(t, log, 4)
+	require.Equal(t, c4, log[0].Hash)
+	require.Equal(t, []Hash{c2, c3}, log[0].Parents)
+	require.Equal(t, tree.Root().merkleHash, log[0].Root)
+	require.Equal(t, "merge", log[0].Message)
+	require.Equal(t, c1, log[3].Hash)
+	require.Empty(t, log[3].Parents)
+
+	loaded, err := DeserializeRefVerified("main", kv)
+	require.Nil(t, err)
+	require.Equal(t, tree.Root().merkleHash, loaded.Root().merkleHash)
+
+	// histories without a shared commit
+	lone, err := history.Write(&Commit{Root: side.Root().merkleHash, Author: "carol", Time: time.Now()})
+	require.Nil(t, err)
+	_, found, err = history.CommonAncestor("main", lone.String())
+	require.Nil(t, err)
+	require.False(t, found)
+	var missing Hash
+	missing[0] = 1
+	_, err = history.Write(&Commit{Root: side.Root().merkleHash, Parents: []Hash{missing}})
+	require.ErrorIs(t, err, ErrCommitFormat)
+	_, err = history.Log(TagRef("nope"))
+	require.ErrorIs(t, err, ErrRefNotFound)
+
+	// the whole history survives GC, commits no ref reaches don't
+	require.Nil(t, refs.Delete(feature, c3))
+	_, err = GC(kv, nil, false)
+	require.Nil(t, err)
+	fsck, err := Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, fsck.OK(), "%v", fsck.Problems)
+	require.Empty(t, fsck.Orphans)
+	for _, hash := range []Hash{c1, c2, c3, c4} {
+		_, err := history.Get(hash)
+		require.Nil(t, err)
+	}
+	_, err = history.Get(lone)
+	require.ErrorIs(t, err, ErrCommitFormat)
+
+	// a tampered commit no longer hashes to its key
+	value, _, err := kv.Get(commitKey(c2))
+	require.Nil(t, err)
+	require.Nil(t, kv.Set(commitKey(c2), append(value, ' ')))
+	_, err = history.Log("main")
+	require.ErrorIs(t, err, ErrCommitFormat)
+	require.Equal(t, []string{FsckCommit}, fsckKinds(t, kv))
+}
+
+func TestCommonAncestorCrissCross(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	history := NewHistory(kv)
+	tree := NewTree(generate1(10), nil)
+	root, err := tree.writeRoot(kv)
+	require.Nil(t, err)
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	commit := func(minutes int, parents ...Hash) Hash {
+		hash, err := history.Write(&Commit{Root: root, Parents: parents, Time: at.Add(time.Duration(minutes) * time.Minute)})
+		require.Nil(t, err)
+		return hash
+	}
+	// both a1 and b1 are merged into each side; the newer one is the base
+	base := commit(0)
+	a1, b1 := commit(1, base), commit(2, base)
+	a2, b2 := commit(3, a1, b1), commit(4, b1, a1)
+	got, found, err := history.CommonAncestor(a2.String(), b2.String())
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, b1, got)
+}
+
+func TestHistoryFromTree(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	history := NewHistory(kv)
+	tree := NewTree(generate1(20), nil)
+	before := tree.Root().merkleHash
+	require.Nil(t, tree.SerializeRef(HEAD, Hash{}, kv))
+
+	// the tree HEAD pointed at becomes the root commit
+	tree.Put([]byte("new"), []byte("entry"))
+	head, err := history.Commit(HEAD, tree, "alice", "edit")
+	require.Nil(t, err)
+	log, err := history.Log(HEAD)
+	require.Nil(t, err)
+	require.Len(t, log, 2)
+	require.Equal(t, head, log[0].Hash)
+	require.Equal(t, []Hash{log[1].Hash}, log[0].Parents)
+	require.Equal(t, before, log[1].Root)
+	require.Empty(t, log[1].Parents)
+
+	// a commit made on a clock that runs behind still comes before its parent
+	skewed, err := history.Write(&Commit{Root: before, Parents: []Hash{head}, Time: log[0].Time.Add(-time.Hour)})
+	require.Nil(t, err)
+	log, err = history.Log(skewed.String())
+	require.Nil(t, err)
+	require.Equal(t, []Hash{skewed, head, log[2].Hash}, []Hash{log[0].Hash, log[1].Hash, log[2].Hash})
+
+	// a store that fails is not mistaken for a missing root
+	_, err = NewHistory(failingKV{kv}).Write(&Commit{Root: before})
+	require.ErrorIs(t, err, errFailingKV)
+	require.NotErrorIs(t, err, ErrNodeMissing)
+}
+
+var errFailingKV = errors.New("disk failure")
+
+// failingKV fails every read of a node.
+type failingKV struct{ KV }
+
+func (kv failingKV) Get(key []byte) ([]byte, bool, error) {
+	if IsKeyWithKids(key) {
+		return nil, false, errFailingKV
+	}
+	return kv.KV.Get(key)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// NodeFormatVersion is the version of the layout written by
+// EncodeValueWithKids.
+const NodeFormatVersion = 1
+
+// TreeConfig holds everything that determines the shape and the hashes of a
+// tree. Two trees are only comparable when their configs are equal, and a
+// stored tree can only be read back with the config it was written with, so
+// SerializeWithKids stores the config next to the root of every generation.
+type TreeConfig struct {
+	Chunker Chunker
+	Hasher  Hasher
+}
+
+func DefaultTreeConfig() *TreeConfig {
+	return &TreeConfig{Chunker: DefaultChunker, Hasher: DefaultHasher}
+}
+
+var ErrConfigMismatch = errors.New("tree config does not match")
+
+// ErrConfigMissing is returned for a store that lacks the config of a tree or
+// the record of its hasher.
+var ErrConfigMissing = errors.New("tree config not found")
+
+// storedConfig is the persisted form of a TreeConfig.
+type storedConfig struct {
+	NodeFormat int    `json:"node_format"`
+	HashSize   int    `json:"hash_size"`
+	Hasher     string `json:"hasher"`
+	Chunker    string `json:"chunker"`
+}
+
+func (c *TreeConfig) stored() storedConfig {
+	return storedConfig{
+		NodeFormat: NodeFormatVersion,
+		HashSize:   HashSize,
+		Hasher:     c.Hasher.Name(),
+		Chunker:    c.Chunker.Name(),
+	}
+}
+
+// Equal reports whether both configs produce the same trees.
+func (c *TreeConfig) Equal(o *TreeConfig) bool { return c.stored() == o.stored() }
+
+func (c *TreeConfig) String() string {
+	return fmt.Sprintf("TreeConfig(hasher=%s, chunker=%s)", c.Hasher.Name(), c.Chunker.Name())
+}
+
+func (c *TreeConfig) MarshalJSON() ([]byte, error) { return json.Marshal(c.stored()) }
+
+// UnmarshalJSON restores a config written by MarshalJSON. It fails when the
+// config was written with a node format or hash size this build can't read,
+// or names an unknown hasher or chunker.
+func (c *TreeConfig) UnmarshalJSON(data []byte) error {
+	var s storedConfig
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s.NodeFormat != NodeFormatVersion {
+		return fmt.Errorf("%w: node format %d, expected %d", ErrConfigMismatch, s.NodeFormat, NodeFormatVersion)
+	}
+	if s.HashSize != HashSize {
+		return fmt.Errorf("%w: hash size %d, expected %d", ErrConfigMismatch, s.HashSize, HashSize)
+	}
+	hasher, err := HasherByName(s.Hasher)
+	if err != nil {
+		return err
+	}
+	chunker, err := ParseChunker(s.Chunker)
+	if err != nil {
+		return err
+	}
+	*c = TreeConfig{Chunker: chunker, Hasher: hasher}
+	return nil
+}
+
+func configKey(gen int) string { return fmt.Sprintf("config:%d", gen) }
+
+// rootConfigKey names the config of a tree stored for a ref. Refs move, so
+// the config is kept with the root hash rather than with the ref.
+func rootConfigKey(root Hash) string { return "config:" + root.String() }
+
+// loadConfig reads the config of generation gen.
+func loadConfig(gen int, kv KV) (*TreeConfig, error) {
+	return readConfig(configKey(gen), kv)
+}
+
+// loadRootConfig reads the config of the tree with the given root.
+func loadRootConfig(root Hash, kv KV) (*TreeConfig, error) {
+	return readConfig(rootConfigKey(root), kv)
+}
+
+func readConfig(key string, kv KV) (*TreeConfig, error) {
+	hasher, err := loadHasher(kv)
+	if err != nil {
+		return nil, err
+	}
+	data, found, err := kv.Get([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %q", ErrConfigMissing, key)
+	}
+	config := &TreeConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	if config.Hasher.Name() != hasher.Name() {
+		return nil, fmt.Errorf("%w: %s uses %q, store uses %q", ErrHasherMismatch, key, config.Hasher.Name(), hasher.Name())
+	}
+	return config, nil
+}
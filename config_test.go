@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChunker(t *testing.T) {
+	chunkers := []Chunker{
+		DefaultChunker,
+		FanoutChunker(4),
+		CDFChunker{Average: 16, K: 2.5},
+		LimitChunker{Chunker: CDFChunker{Average: 8, K: 1}, MinEntries: 2, MaxEntries: 64, MinBytes: 0, MaxBytes: 4096},
+		LimitChunker{Chunker: LimitChunker{Chunker: FanoutChunker(8), MaxEntries: 10}, MinEntries: 1},
+	}
+	for _, chunker := range chunkers {
+		parsed, err := ParseChunker(chunker.Name())
+		require.Nil(t, err, chunker.Name())
+		require.Equal(t, chunker, parsed)
+	}
+	for _, bad := range []string{"", "fanout:4", "threshold:x", "cdf:0:1", "limit:1:2:3:cdf:4:1", "limit:1:2:3:4:nope",
+		"threshold:5junk", "threshold:5:6", "threshold:-1", "cdf:8:2x", "cdf:8", "cdf:8:2:3",
+		"cdf:8589934593:4"} {
+		_, err := ParseChunker(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestConfigPerGeneration(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	configs := []*TreeConfig{
+		DefaultTreeConfig(),
+		withChunker(FanoutChunker(4)),
+		withChunker(CDFChunker{Average: 8, K: 2}),
+	}
+	for i, config := range configs {
+		tree := NewTree(generate1(100), config)
+		require.Nil(t, tree.SerializeWithKids(i+1, kv))
+	}
+	for i, config := range configs {
+		loaded, err := DeserializeWithKids(i+1, kv)
+		require.Nil(t, err)
+		require.True(t, config.Equal(loaded.Config()), "%v != %v", config, loaded.Config())
+		require.Equal(t, NewTree(generate1(100), config).Root().merkleHash, loaded.Root().merkleHash)
+	}
+}
+
+func TestConfigMismatch(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	require.Nil(t, NewTree(generate1(100), withChunker(FanoutChunker(4))).SerializeWithKids(1, kv))
+
+	setConfig := func(config any) {
+		data, err := json.Marshal(config)
+		require.Nil(t, err)
+		require.Nil(t, kv.Set([]byte(configKey(1)), data))
+	}
+
+	// a different chunker rebuilds a different tree
+	setConfig(DefaultTreeConfig())
+	_, err := DeserializeWithKids(1, kv)
+	require.ErrorIs(t, err, ErrConfigMismatch)
+
+	stored := withChunker(FanoutChunker(4)).stored()
+	stored.HashSize = 20
+	setConfig(stored)
+	_, err = DeserializeWithKids(1, kv)
+	require.ErrorIs(t, err, ErrConfigMismatch)
+
+	stored = withChunker(FanoutChunker(4)).stored()
+	stored.NodeFormat = NodeFormatVersion + 1
+	setConfig(stored)
+	_, err = DeserializeWithKids(1, kv)
+	require.ErrorIs(t, err, ErrConfigMismatch)
+
+	stored = withChunker(FanoutChunker(4)).stored()
+	stored.Chunker = "rolling:12"
+	setConfig(stored)
+	_, err = DeserializeWithKids(1, kv)
+	require.Error(t, err)
+
+	setConfig(withChunker(FanoutChunker(4)))
+	_, err = DeserializeWithKids(1, kv)
+	require.Nil(t, err)
+
+	// nothing is guessed for a store that lacks the config or the hasher
+	require.Nil(t, kv.Delete([]byte(configKey(1))))
+	_, err = DeserializeWithKids(1, kv)
+	require.ErrorIs(t, err, ErrConfigMissing)
+	require.Equal(t, []string{FsckConfig}, fsckKinds(t, kv))
+	setConfig(withChunker(FanoutChunker(4)))
+	require.Nil(t, kv.Delete([]byte(HasherKey)))
+	_, err = DeserializeWithKids(1, kv)
+	require.ErrorIs(t, err, ErrConfigMissing)
+}
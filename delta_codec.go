@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Deltas travel in two encodings that carry the same information:
+//
+//   - JSON lines: a header object followed by one object per delta.
+//   - binary: a magic string, the header fields and then the deltas, with
+//     every string prefixed by its uvarint length.
+//
+// The header names the format version, the source and target root hashes,
+// and the number of deltas of each kind so that truncated input is detected.
+// Root hashes are hex in JSON and raw bytes in the binary encoding. Keys and
+// values are base64 in JSON.
+
+const DeltaFormat = "prollykv-delta"
+const DeltaFormatVersion = 1
+
+var deltaMagic = []byte("PKVD")
+
+var ErrDeltaFormat = errors.New("invalid delta encoding")
+var ErrWrongBase = errors.New("delta does not apply to this base root")
+
+type deltaHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Source  Hash   `json:"source"`
+	Target  Hash   `json:"target"`
+	Add     int    `json:"add"`
+	Remove  int    `json:"remove"`
+	Update  int    `json:"update"`
+}
+
+type deltaRecord struct {
+	Op     string `json:"op"`
+	Key    []byte `json:"key"`
+	Source []byte `json:"source,omitempty"`
+	Target []byte `json:"target,omitempty"`
+}
+
+func headerOf(d DeltaTrio) deltaHeader {
+	return deltaHeader{
+		Format:  DeltaFormat,
+		Version: DeltaFormatVersion,
+		Source:  d.SourceRoot,
+		Target:  d.TargetRoot,
+		Add:     len(d.Add),
+		Remove:  len(d.Remove),
+		Update:  len(d.Update),
+	}
+}
+
+// check validates the header and makes sure the deltas were computed against
+// baseRoot, the root hash of the tree they are about to be applied to.
+func (h deltaHeader) check(baseRoot Hash) error {
+	if h.Format != DeltaFormat {
+		return fmt.Errorf("%w: unknown format %q", ErrDeltaFormat, h.Format)
+	}
+	if h.Version != DeltaFormatVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrDeltaFormat, h.Version)
+	}
+	if h.Add < 0 || h.Remove < 0 || h.Update < 0 {
+		return fmt.Errorf("%w: negative delta count", ErrDeltaFormat)
+	}
+	if h.Source != baseRoot {
+		return fmt.Errorf("%w: delta is for %s, base is %s", ErrWrongBase, h.Source, baseRoot)
+	}
+	return nil
+}
+
+func EncodeDeltaJSON(w io.Writer, d DeltaTrio) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(headerOf(d)); err != nil {
+		return err
+	}
+	for _, deltas := range [][]Delta{d.Add, d.Remove, d.Update} {
+		for _, delta := range deltas {
+			r := deltaRecord{Op: delta.typ, Key: delta.key, Source: delta.source, Target: delta.target}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func DecodeDeltaJSON(r io.Reader, baseRoot Hash) (DeltaTrio, error) {
+	dec := json.NewDecoder(r)
+	var h deltaHeader
+	if err := dec.Decode(&h); err != nil {
+		return DeltaTrio{}, fmt.Errorf("%w: header: %v", ErrDeltaFormat, err)
+	}
+	if err := h.check(baseRoot); err != nil {
+		return DeltaTrio{}, err
+	}
+	d := newDeltaTrio(h)
+	for range h.Add + h.Remove + h.Update {
+		var rec deltaRecord
+		if err := dec.Decode(&rec); err != nil {
+			return DeltaTrio{}, fmt.Errorf("%w: delta: %v", ErrDeltaFormat, err)
+		}
+		delta := withEmptyValues(Delta{key: rec.Key, typ: rec.Op, source: rec.Source, target: rec.Target})
+		switch rec.Op {
+		case "add":
+			d.Add = append(d.Add, delta)
+		case "remove":
+			d.Remove = append(d.Remove, delta)
+		case "update":
+			d.Update = append(d.Update, delta)
+		default:
+			return DeltaTrio{}, fmt.Errorf("%w: unknown op %q", ErrDeltaFormat, rec.Op)
+		}
+	}
+	if len(d.Add) != h.Add || len(d.Remove) != h.Remove || len(d.Update) != h.Update {
+		return DeltaTrio{}, fmt.Errorf("%w: delta counts do not match the header", ErrDeltaFormat)
+	}
+	if dec.More() {
+		return DeltaTrio{}, fmt.Errorf("%w: trailing data", ErrDeltaFormat)
+	}
+	return d, nil
+}
+
+func EncodeDeltaBinary(w io.Writer, d DeltaTrio) error {
+	bw := bufio.NewWriter(w)
+	h := headerOf(d)
+	bw.Write(deltaMagic)
+	writeUvarint(bw, uint64(h.Version))
+	writeBytes(bw, h.Source[:])
+	writeBytes(bw, h.Target[:])
+	writeUvarint(bw, uint64(h.Add))
+	writeUvarint(bw, uint64(h.Remove))
+	writeUvarint(bw, uint64(h.Update))
+	for _, deltas := range [][]Delta{d.Add, d.Remove, d.Update} {
+		for _, delta := range deltas {
+			writeBytes(bw, delta.key)
+			writeBytes(bw, delta.source)
+			writeBytes(bw, delta.target)
+		}
+	}
+	return bw.Flush()
+}
+
+func DecodeDeltaBinary(r io.Reader, baseRoot Hash) (d DeltaTrio, err error) {
+	br := bufio.NewReader(r)
+	defer func() {
+		if err != nil && !errors.Is(err, ErrWrongBase) && !errors.Is(err, ErrDeltaFormat) {
+			err = fmt.Errorf("%w: %v", ErrDeltaFormat, err)
+		}
+	}()
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return DeltaTrio{}, err
+	}
+	if string(magic) != string(deltaMagic) {
+		return DeltaTrio{}, fmt.Errorf("%w: bad magic %q", ErrDeltaFormat, magic)
+	}
+	h := deltaHeader{Format: DeltaFormat}
+	var counts [4]uint64
+	if counts[0], err = binary.ReadUvarint(br); err != nil {
+		return DeltaTrio{}, err
+	}
+	if h.Source, err = readRoot(br); err != nil {
+		return DeltaTrio{}, err
+	}
+	if h.Target, err = readRoot(br); err != nil {
+		return DeltaTrio{}, err
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i], err = binary.ReadUvarint(br); err != nil {
+			return DeltaTrio{}, err
+		}
+	}
+	const maxCount = 1 << 40
+	for _, c := range counts {
+		if c > maxCount {
+			return DeltaTrio{}, fmt.Errorf("%w: count %d is too large", ErrDeltaFormat, c)
+		}
+	}
+	h.Version, h.Add, h.Remove, h.Update = int(counts[0]), int(counts[1]), int(counts[2]), int(counts[3])
+	if err := h.check(baseRoot); err != nil {
+		return DeltaTrio{}, err
+	}
+	d = newDeltaTrio(h)
+	read := func(n int, typ string, into *[]Delta) error {
+		for range n {
+			var delta Delta
+			delta.typ = typ
+			if delta.key, err = readBytes(br); err != nil {
+				return err
+			}
+			if delta.source, err = readBytes(br); err != nil {
+				return err
+			}
+			if delta.target, err = readBytes(br); err != nil {
+				return err
+			}
+			*into = append(*into, withEmptyValues(delta))
+		}
+		return nil
+	}
+	if err := read(h.Add, "add", &d.Add); err != nil {
+		return DeltaTrio{}, err
+	}
+	if err := read(h.Remove, "remove", &d.Remove); err != nil {
+		return DeltaTrio{}, err
+	}
+	if err := read(h.Update, "update", &d.Update); err != nil {
+		return DeltaTrio{}, err
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return DeltaTrio{}, fmt.Errorf("%w: trailing data", ErrDeltaFormat)
+	}
+	return d, nil
+}
+
+func readRoot(r *bufio.Reader) (Hash, error) {
+	b, err := readBytes(r)
+	if err != nil {
+		return Hash{}, err
+	}
+	return HashFromBytes(b)
+}
+
+// withEmptyValues turns the values that the op implies into empty rather than
+// nil slices: neither encoding tells an empty value apart from a missing one.
+func withEmptyValues(d Delta) Delta {
+	if d.source == nil && (d.typ == "update" || d.typ == "remove") {
+		d.source = []byte{}
+	}
+	if d.target == nil && (d.typ == "update" || d.typ == "add") {
+		d.target = []byte{}
+	}
+	return d
+}
+
+func newDeltaTrio(h deltaHeader) DeltaTrio {
+	return DeltaTrio{
+		Add:        []Delta{},
+		Remove:     []Delta{},
+		Update:     []Delta{},
+		SourceRoot: h.Source,
+		TargetRoot: h.Target,
+	}
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func writeBytes(w *bufio.Writer, b []byte) {
+	writeUvarint(w, uint64(len(b)))
+	w.Write(b)
+}
+
+// maxBytesSize bounds the length prefix accepted by readBytes, so that
+// garbage input can't make the decoder allocate unbounded memory.
+const maxBytesSize = 1 << 30
+
+// readBytes returns nil for an empty byte string, as the encoder doesn't tell
+// it apart from a missing one.
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBytesSize {
+		return nil, fmt.Errorf("%w: byte string of %d bytes is too large", ErrDeltaFormat, n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
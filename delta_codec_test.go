@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaCodec(t *testing.T) {
+	source := mapOf(generateSorted(100))
+	target := maps.Clone(source)
+	delete(target, "0001")
+	target["0002"] = "updated\nwith \"quotes\""
+	target["0500"] = ""
+	sourceTree := NewTree(messagesOf(source), nil)
+	targetTree := NewTree(messagesOf(target), nil)
+	d := Diff(sourceTree, targetTree)
+	base := sourceTree.Root().merkleHash
+
+	codecs := []struct {
+		name   string
+		encode func(*bytes.Buffer, DeltaTrio) error
+		decode func(*bytes.Reader, Hash) (DeltaTrio, error)
+	}{
+		{"json",
+			func(b *bytes.Buffer, d DeltaTrio) error { return EncodeDeltaJSON(b, d) },
+			func(r *bytes.Reader, base Hash) (DeltaTrio, error) { return DecodeDeltaJSON(r, base) }},
+		{"binary",
+			func(b *bytes.Buffer, d DeltaTrio) error { return EncodeDeltaBinary(b, d) },
+			func(r *bytes.Reader, base Hash) (DeltaTrio, error) { return DecodeDeltaBinary(r, base) }},
+	}
+	for _, c := range codecs {
+		var buf bytes.Buffer
+		require.Nil(t, c.encode(&buf, d), c.name)
+		encoded := buf.Bytes()
+
+		decoded, err := c.decode(bytes.NewReader(encoded), base)
+		require.Nil(t, err, c.name)
+		require.Equal(t, d, decoded, c.name)
+
+		tree := NewTree(messagesOf(source), nil)
+		require.Nil(t, tree.Patch(decoded), c.name)
+		require.Equal(t, targetTree.Root().merkleHash, tree.Root().merkleHash, c.name)
+
+		_, err = c.decode(bytes.NewReader(encoded), targetTree.Root().merkleHash)
+		require.ErrorIs(t, err, ErrWrongBase, c.name)
+
+		for _, n := range []int{0, 3, len(encoded) / 2, len(encoded) - 3} {
+			_, err = c.decode(bytes.NewReader(encoded[:n]), base)
+			require.ErrorIs(t, err, ErrDeltaFormat, "%s truncated at %d", c.name, n)
+		}
+		_, err = c.decode(bytes.NewReader(append(bytes.Clone(encoded), encoded...)), base)
+		require.ErrorIs(t, err, ErrDeltaFormat, c.name)
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, EncodeDeltaJSON(&buf, d))
+	version := fmt.Sprintf(`"version":%d`, DeltaFormatVersion)
+	future := strings.Replace(buf.String(), version, fmt.Sprintf(`"version":%d`, DeltaFormatVersion+1), 1)
+	_, err := DecodeDeltaJSON(strings.NewReader(future), base)
+	require.ErrorIs(t, err, ErrDeltaFormat)
+
+	buf.Reset()
+	require.Nil(t, EncodeDeltaBinary(&buf, d))
+	encoded := buf.Bytes()
+	encoded[0] = 'X'
+	_, err = DecodeDeltaBinary(bytes.NewReader(encoded), base)
+	require.ErrorIs(t, err, ErrDeltaFormat)
+}
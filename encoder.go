@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"strings"
+	"math"
+	"math/bits"
+	"strconv"
+	"time"
 )
 
+var ErrNodeFormat = errors.New("invalid node encoding")
+
 func EncodeKey(level int8, key []byte) []byte {
 	sLevel := fmt.Sprintf("%02d", level)
 	return append([]byte(sLevel), key...)
 }
 
-func EncodeValue(hash []byte, value []byte) []byte {
-	return append(hash, value...)
+func EncodeValue(hash Hash, value []byte) []byte {
+	return append(hash[:], value...)
 }
 
 func DecodeKey(data []byte) (int8, []byte) {
@@ -21,69 +29,420 @@ func DecodeKey(data []byte) (int8, []byte) {
 	return level, data[2:]
 }
 
-func DecodeValue(data []byte) ([]byte, []byte) {
-	return data[:HashSize], data[HashSize:]
+func DecodeValue(data []byte) (Hash, []byte) {
+	return Hash(data[:HashSize]), data[HashSize:]
 }
 
-func StrEncodeKey(level int8, key string) string {
-	sLevel := fmt.Sprintf("%02d", level)
-	return sLevel + key
-}
+// NodePrefix starts the KV keys of nodes written by SerializeWithKids, so that
+// no other key of a store can pass for a node.
+const NodePrefix = "node:"
 
-func StrDecodeKey(data string) (int8, string) {
-	level := int8(0)
-	_, err := fmt.Sscanf(data[:2], "%d", &level)
-	mustNil(err)
-	return level, data[2:]
+func EncodeKeyWithKids(hash Hash) []byte {
+	return append([]byte(NodePrefix), hash[:]...)
 }
 
-func StrEncodeValue(hash string, value string) string {
-	return hash[:HashSize] + value // TODO: remove later, use the whole hash
+// DecodeKeyWithKids returns the hash of the node stored under key and false
+// when key is not the key of a node.
+func DecodeKeyWithKids(key []byte) (Hash, bool) {
+	hash, ok := bytes.CutPrefix(key, []byte(NodePrefix))
+	if !ok || len(hash) != HashSize {
+		return Hash{}, false
+	}
+	return Hash(hash), true
 }
 
-func StrDecodeValue(data string) (string, string) {
-	return data[:HashSize], data[HashSize:]
+// IsKeyWithKids tells the keys of nodes written by SerializeWithKids from the
+// other keys of a store.
+func IsKeyWithKids(key []byte) bool {
+	_, ok := DecodeKeyWithKids(key)
+	return ok
 }
 
-func StrEncodeKeyWithKids(hash string) string {
-	return hash[:HashSize]
+const (
+	tailFlag    = 'T'
+	notTailFlag = '-'
+)
+
+// EncodedSizeWithKids is the length of EncodeValueWithKids output.
+func EncodedSizeWithKids(nKids int, key []byte, value []byte) int {
+	return 2 + 1 + uvarintSize(len(key)) + len(key) + uvarintSize(nKids) + nKids*HashSize + len(value)
 }
 
-func StrDecodeKeyWithKids(data string) string {
-	return data[:HashSize]
+func uvarintSize(n int) int {
+	return len(binary.AppendUvarint(nil, uint64(n)))
 }
 
-func StrEncodeValueWithKids(level int8, kids []string, key string, data string) string {
-	// level, nKids, kids, data
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("%02d", level))
-	sb.WriteString(fmt.Sprintf("%05d", len(key)))
-	sb.WriteString(key)
-	sb.WriteString(fmt.Sprintf("%04d", len(kids)))
+// EncodeValueWithKids lays out a node as: level, tail flag, key length, key,
+// number of kids, kids and finally the value, which takes the rest. Lengths
+// are uvarints, so neither the key nor the kids are limited in number.
+func EncodeValueWithKids(level int8, isTail bool, kids []Hash, key []byte, value []byte) []byte {
+	out := make([]byte, 0, EncodedSizeWithKids(len(kids), key, value))
+	out = fmt.Appendf(out, "%02d", level)
+	if isTail {
+		out = append(out, tailFlag)
+	} else {
+		out = append(out, notTailFlag)
+	}
+	out = binary.AppendUvarint(out, uint64(len(key)))
+	out = append(out, key...)
+	out = binary.AppendUvarint(out, uint64(len(kids)))
 	for _, kid := range kids {
-		sb.WriteString(kid[:HashSize])
+		out = append(out, kid[:]...)
 	}
-	sb.WriteString(data)
-	return sb.String()
+	return append(out, value...)
 }
 
-func StrDecodeValueWithKids(data string) (level int8, kids []string, key string, data_ string) {
-	_, err := fmt.Sscanf(data[:2], "%d", &level)
-	mustNil(err)
-	keySize := 0
-	_, err = fmt.Sscanf(data[2:7], "%d", &keySize)
-	mustNil(err)
-	key = data[7 : 7+keySize]
-	offset := 7 + keySize
-	nKids := 0
-	_, err = fmt.Sscanf(data[offset:offset+4], "%d", &nKids)
-	mustNil(err)
-	offset += 4
-	kids = make([]string, nKids)
+// DecodeValueWithKids reverses EncodeValueWithKids. The returned key and value
+// share memory with data.
+func DecodeValueWithKids(data []byte) (level int8, isTail bool, kids []Hash, key []byte, value []byte, err error) {
+	if len(data) < 3 {
+		err = fmt.Errorf("%w: truncated at %d", ErrNodeFormat, len(data))
+		return
+	}
+	n, err := strconv.ParseUint(string(data[:2]), 10, 7)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrNodeFormat, err)
+		return
+	}
+	level = int8(n)
+	switch data[2] {
+	case tailFlag:
+		isTail = true
+	case notTailFlag:
+	default:
+		err = fmt.Errorf("%w: bad tail flag %q", ErrNodeFormat, data[2])
+		return
+	}
+	offset := 3
+	// length reads a uvarint that counts items of size bytes following it
+	length := func(size int) (int, error) {
+		n, width := binary.Uvarint(data[offset:])
+		if width <= 0 {
+			return 0, fmt.Errorf("%w: bad length at %d", ErrNodeFormat, offset)
+		}
+		offset += width
+		if n > uint64((len(data)-offset)/size) {
+			return 0, fmt.Errorf("%w: truncated at %d", ErrNodeFormat, offset)
+		}
+		return int(n), nil
+	}
+	keySize, err := length(1)
+	if err != nil {
+		return
+	}
+	key = data[offset : offset+keySize]
+	offset += keySize
+	nKids, err := length(HashSize)
+	if err != nil {
+		return
+	}
+	kids = make([]Hash, nKids)
 	for i := range nKids {
-		kids[i] = data[offset : offset+HashSize]
+		copy(kids[i][:], data[offset:offset+HashSize])
 		offset += HashSize
 	}
-	data_ = data[offset:]
+	value = data[offset:]
 	return
 }
+
+// Tuple is a composite key. EncodeTuple turns it into bytes whose
+// lexicographic order matches the order of the tuples compared element by
+// element, so that e.g. (user, timestamp) keys can be range scanned by user.
+// The layout follows the FoundationDB tuple layer.
+//
+// Elements may be nil, bool, []byte, string, any signed or unsigned integer,
+// float32, float64, time.Time and nested Tuples. Elements of different types
+// order by type: nil, []byte, string, Tuple, integers, float32, float64, bool
+// and time.Time. DecodeTuple returns integers as int64, or uint64 when they
+// don't fit, and times in UTC.
+type Tuple []any
+
+var ErrTupleFormat = errors.New("invalid tuple encoding")
+
+const (
+	tupleNil     = 0x00
+	tupleBytes   = 0x01
+	tupleString  = 0x02
+	tupleNested  = 0x05
+	tupleIntZero = 0x14 // 0x0c..0x1c, the distance from zero is the length
+	tupleFloat32 = 0x20
+	tupleFloat64 = 0x21
+	tupleFalse   = 0x26
+	tupleTrue    = 0x27
+	tupleTime    = 0x34
+	tupleEscape  = 0xff
+)
+
+func EncodeTuple(t Tuple) ([]byte, error) {
+	var out []byte
+	for _, e := range t {
+		var err error
+		if out, err = appendTupleElement(out, e, false); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func MustEncodeTuple(t Tuple) []byte {
+	out, err := EncodeTuple(t)
+	mustNil(err)
+	return out
+}
+
+// TuplePrefixRange returns the [start, end) range that holds exactly the keys
+// whose tuples start with the elements of prefix.
+func TuplePrefixRange(prefix Tuple) (start []byte, end []byte, err error) {
+	if start, err = EncodeTuple(prefix); err != nil {
+		return nil, nil, err
+	}
+	// no element starts with 0xff
+	return start, append(bytes.Clone(start), 0xff), nil
+}
+
+func appendTupleElement(out []byte, e any, nested bool) ([]byte, error) {
+	switch v := e.(type) {
+	case nil:
+		if nested {
+			return append(out, tupleNil, tupleEscape), nil
+		}
+		return append(out, tupleNil), nil
+	case bool:
+		if v {
+			return append(out, tupleTrue), nil
+		}
+		return append(out, tupleFalse), nil
+	case []byte:
+		return appendTupleBytes(append(out, tupleBytes), v), nil
+	case string:
+		return appendTupleBytes(append(out, tupleString), []byte(v)), nil
+	case Tuple:
+		out = append(out, tupleNested)
+		for _, x := range v {
+			var err error
+			if out, err = appendTupleElement(out, x, true); err != nil {
+				return nil, err
+			}
+		}
+		return append(out, 0x00), nil
+	case int:
+		return appendTupleInt(out, int64(v)), nil
+	case int8:
+		return appendTupleInt(out, int64(v)), nil
+	case int16:
+		return appendTupleInt(out, int64(v)), nil
+	case int32:
+		return appendTupleInt(out, int64(v)), nil
+	case int64:
+		return appendTupleInt(out, v), nil
+	case uint:
+		return appendTupleUint(out, uint64(v)), nil
+	case uint8:
+		return appendTupleUint(out, uint64(v)), nil
+	case uint16:
+		return appendTupleUint(out, uint64(v)), nil
+	case uint32:
+		return appendTupleUint(out, uint64(v)), nil
+	case uint64:
+		return appendTupleUint(out, v), nil
+	case float32:
+		bits := math.Float32bits(v)
+		if bits&(1<<31) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 31
+		}
+		return binary.BigEndian.AppendUint32(append(out, tupleFloat32), bits), nil
+	case float64:
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(append(out, tupleFloat64), bits), nil
+	case time.Time:
+		out = append(out, tupleTime)
+		out = binary.BigEndian.AppendUint64(out, uint64(v.Unix())^(1<<63))
+		return binary.BigEndian.AppendUint32(out, uint32(v.Nanosecond())), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported element type %T", ErrTupleFormat, e)
+	}
+}
+
+// appendTupleBytes writes b terminated by 0x00, escaping its zero bytes as
+// 0x00 0xff so that the terminator sorts before any continuation.
+func appendTupleBytes(out []byte, b []byte) []byte {
+	for _, c := range b {
+		out = append(out, c)
+		if c == 0x00 {
+			out = append(out, tupleEscape)
+		}
+	}
+	return append(out, 0x00)
+}
+
+func appendTupleUint(out []byte, v uint64) []byte {
+	n := (bits.Len64(v) + 7) / 8
+	out = append(out, byte(tupleIntZero+n))
+	for i := n - 1; i >= 0; i-- {
+		out = append(out, byte(v>>(8*i)))
+	}
+	return out
+}
+
+// appendTupleInt writes negative numbers as the one's complement of their
+// magnitude, so that larger magnitudes sort first.
+func appendTupleInt(out []byte, v int64) []byte {
+	if v >= 0 {
+		return appendTupleUint(out, uint64(v))
+	}
+	magnitude := uint64(-(v + 1)) + 1
+	n := (bits.Len64(magnitude) + 7) / 8
+	out = append(out, byte(tupleIntZero-n))
+	c := ^magnitude
+	for i := n - 1; i >= 0; i-- {
+		out = append(out, byte(c>>(8*i)))
+	}
+	return out
+}
+
+func DecodeTuple(data []byte) (Tuple, error) {
+	t := Tuple{}
+	for len(data) > 0 {
+		e, rest, err := decodeTupleElement(data, false)
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, e)
+		data = rest
+	}
+	return t, nil
+}
+
+func decodeTupleElement(data []byte, nested bool) (any, []byte, error) {
+	code, data := data[0], data[1:]
+	need := func(n int) error {
+		if len(data) < n {
+			return fmt.Errorf("%w: truncated element 0x%02x", ErrTupleFormat, code)
+		}
+		return nil
+	}
+	switch {
+	case code == tupleNil:
+		if nested {
+			if err := need(1); err != nil || data[0] != tupleEscape {
+				return nil, nil, fmt.Errorf("%w: bad nil in nested tuple", ErrTupleFormat)
+			}
+			data = data[1:]
+		}
+		return nil, data, nil
+	case code == tupleBytes || code == tupleString:
+		b, rest, err := decodeTupleBytes(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if code == tupleString {
+			return string(b), rest, nil
+		}
+		return b, rest, nil
+	case code == tupleNested:
+		t := Tuple{}
+		for {
+			if err := need(1); err != nil {
+				return nil, nil, err
+			}
+			if data[0] == 0x00 && (len(data) == 1 || data[1] != tupleEscape) {
+				return t, data[1:], nil
+			}
+			e, rest, err := decodeTupleElement(data, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			t = append(t, e)
+			data = rest
+		}
+	case code >= tupleIntZero-8 && code <= tupleIntZero+8:
+		n := int(code) - tupleIntZero
+		negative := n < 0
+		if negative {
+			n = -n
+		}
+		if err := need(n); err != nil {
+			return nil, nil, err
+		}
+		var v uint64
+		for _, c := range data[:n] {
+			v = v<<8 | uint64(c)
+		}
+		data = data[n:]
+		if !negative {
+			if v > math.MaxInt64 {
+				return v, data, nil
+			}
+			return int64(v), data, nil
+		}
+		if n > 0 {
+			v = ^v & (math.MaxUint64 >> (64 - 8*n))
+		}
+		if v > 1<<63 {
+			return nil, nil, fmt.Errorf("%w: integer below the int64 range", ErrTupleFormat)
+		}
+		return -int64(v-1) - 1, data, nil
+	case code == tupleFloat32:
+		if err := need(4); err != nil {
+			return nil, nil, err
+		}
+		bits := binary.BigEndian.Uint32(data)
+		if bits&(1<<31) != 0 {
+			bits &^= 1 << 31
+		} else {
+			bits = ^bits
+		}
+		return math.Float32frombits(bits), data[4:], nil
+	case code == tupleFloat64:
+		if err := need(8); err != nil {
+			return nil, nil, err
+		}
+		bits := binary.BigEndian.Uint64(data)
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), data[8:], nil
+	case code == tupleFalse:
+		return false, data, nil
+	case code == tupleTrue:
+		return true, data, nil
+	case code == tupleTime:
+		if err := need(12); err != nil {
+			return nil, nil, err
+		}
+		sec := int64(binary.BigEndian.Uint64(data) ^ (1 << 63))
+		nsec := int64(binary.BigEndian.Uint32(data[8:]))
+		return time.Unix(sec, nsec).UTC(), data[12:], nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown type code 0x%02x", ErrTupleFormat, code)
+	}
+}
+
+func decodeTupleBytes(data []byte) ([]byte, []byte, error) {
+	var out []byte
+	for i := 0; i < len(data); i++ {
+		if data[i] != 0x00 {
+			out = append(out, data[i])
+			continue
+		}
+		if i+1 < len(data) && data[i+1] == tupleEscape {
+			out = append(out, 0x00)
+			i++
+			continue
+		}
+		if out == nil {
+			out = []byte{}
+		}
+		return out, data[i+1:], nil
+	}
+	return nil, nil, fmt.Errorf("%w: unterminated byte string", ErrTupleFormat)
+}
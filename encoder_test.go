@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Neither the number of kids nor the length of the key is limited.
+func TestNodeEncoding(t *testing.T) {
+	kids := make([]Hash, 10200)
+	for i := range kids {
+		kids[i][0], kids[i][1] = byte(i), byte(i>>8)
+	}
+	key, value := bytes.Repeat([]byte("k"), 100000), []byte("value")
+	encoded := EncodeValueWithKids(3, true, kids, key, value)
+	require.Len(t, encoded, EncodedSizeWithKids(len(kids), key, value))
+	level, isTail, decodedKids, decodedKey, decodedValue, err := DecodeValueWithKids(encoded)
+	require.Nil(t, err)
+	require.Equal(t, int8(3), level)
+	require.True(t, isTail)
+	require.Equal(t, kids, decodedKids)
+	require.Equal(t, key, decodedKey)
+	require.Equal(t, value, decodedValue)
+
+	encoded = EncodeValueWithKids(0, false, nil, []byte("key"), nil)
+	for i := range len(encoded) - 1 {
+		_, _, _, _, _, err := DecodeValueWithKids(encoded[:i])
+		require.ErrorIs(t, err, ErrNodeFormat, i)
+	}
+	_, _, _, _, _, err = DecodeValueWithKids(EncodeValueWithKids(0, false, kids[:2], nil, nil)[:40])
+	require.ErrorIs(t, err, ErrNodeFormat)
+}
+
+func TestTupleRoundTrip(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	tuples := []Tuple{
+		{},
+		{nil, true, false},
+		{[]byte{}, []byte{0, 1, 0xff, 0}, "", "a\x00b"},
+		{int64(0), int64(1), int64(-1), int64(255), int64(-256), int64(math.MaxInt64), int64(math.MinInt64)},
+		{uint64(math.MaxUint64), uint64(1 << 63)},
+		{float32(-1.5), float32(0), 2.25, math.Inf(-1), math.Inf(1)},
+		{now, time.Unix(-1e10, 5).UTC()},
+		{Tuple{}, Tuple{nil, "x", Tuple{int64(7), nil}}, "after"},
+	}
+	for _, tuple := range tuples {
+		encoded, err := EncodeTuple(tuple)
+		require.Nil(t, err)
+		decoded, err := DecodeTuple(encoded)
+		require.Nil(t, err)
+		require.Equal(t, tuple, decoded)
+	}
+
+	decoded, err := DecodeTuple(MustEncodeTuple(Tuple{7, int8(-3), uint16(9), now.In(time.FixedZone("x", 3600))}))
+	require.Nil(t, err)
+	require.Equal(t, Tuple{int64(7), int64(-3), int64(9), now}, decoded)
+
+	_, err = EncodeTuple(Tuple{struct{}{}})
+	require.ErrorIs(t, err, ErrTupleFormat)
+	for _, bad := range [][]byte{{0x02, 'a'}, {0x15}, {0x21, 1}, {0x05, 0x02, 0x00}, {0x99}} {
+		_, err = DecodeTuple(bad)
+		require.ErrorIs(t, err, ErrTupleFormat, "%x", bad)
+	}
+}
+
+func TestTupleOrder(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(11, 12))
+	requireOrdered := func(n int, gen func() any, less func(a, b any) bool) {
+		values := make([]any, n)
+		for i := range values {
+			values[i] = gen()
+		}
+		slices.SortFunc(values, func(a, b any) int {
+			if less(a, b) {
+				return -1
+			}
+			if less(b, a) {
+				return 1
+			}
+			return 0
+		})
+		for i := 1; i < len(values); i++ {
+			a, b := MustEncodeTuple(Tuple{values[i-1]}), MustEncodeTuple(Tuple{values[i]})
+			require.LessOrEqual(t, bytes.Compare(a, b), 0, "%v %v", values[i-1], values[i])
+		}
+	}
+	requireOrdered(2000, func() any {
+		return int64(rnd.Uint64()) >> rnd.IntN(64)
+	}, func(a, b any) bool { return a.(int64) < b.(int64) })
+	requireOrdered(2000, func() any {
+		return rnd.Uint64() >> rnd.IntN(64)
+	}, func(a, b any) bool { return a.(uint64) < b.(uint64) })
+	requireOrdered(2000, func() any {
+		return rnd.NormFloat64() * math.Pow(10, float64(rnd.IntN(20)-10))
+	}, func(a, b any) bool { return a.(float64) < b.(float64) })
+	requireOrdered(2000, func() any {
+		return time.Unix(rnd.Int64N(1e11)-5e10, rnd.Int64N(1e9))
+	}, func(a, b any) bool { return a.(time.Time).Before(b.(time.Time)) })
+	requireOrdered(2000, func() any {
+		b := make([]byte, rnd.IntN(4))
+		for i := range b {
+			b[i] = byte(rnd.IntN(3))
+		}
+		return string(b)
+	}, func(a, b any) bool { return a.(string) < b.(string) })
+}
+
+func TestTupleKeysRangeScan(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var messages []*Message
+	for _, user := range []string{"ann", "bob", "bobby"} {
+		for i := range 12 {
+			key := MustEncodeTuple(Tuple{user, start.Add(time.Duration(i) * time.Hour)})
+			messages = append(messages, NewMessage(key, []byte(user)))
+		}
+	}
+	tree := NewTree(messages, nil)
+
+	from, to, err := TuplePrefixRange(Tuple{"bob"})
+	require.Nil(t, err)
+	it := tree.Range(from, to)
+	var times []time.Time
+	for ok := it.First(); ok; ok = it.Next() {
+		tuple, err := DecodeTuple(it.Key())
+		require.Nil(t, err)
+		require.Equal(t, "bob", tuple[0])
+		times = append(times, tuple[1].(time.Time))
+	}
+	require.Len(t, times, 12)
+	require.True(t, slices.IsSortedFunc(times, time.Time.Compare))
+
+	// hours 2 up to 5 of bob
+	from = MustEncodeTuple(Tuple{"bob", start.Add(2 * time.Hour)})
+	to = MustEncodeTuple(Tuple{"bob", start.Add(5 * time.Hour)})
+	require.Len(t, collectRange(tree.Range(from, to), false), 3)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of problems found by Fsck.
+const (
+	FsckBadRoot      = "bad_root"      // root:<gen> or a ref can't be parsed
+	FsckDanglingRoot = "dangling_root" // root:<gen> or a ref names a node that isn't stored
+	FsckConfig       = "config"        // the config of a generation or ref can't be loaded
+	FsckMissingNode  = "missing_node"  // a kid that isn't stored
+	FsckDecode       = "decode"        // a node that doesn't decode
+	FsckHash         = "hash"          // a node whose content doesn't hash to its key
+	FsckLevel        = "level"         // kids that are not exactly one level below
+	FsckOrder        = "order"         // kids out of key order, or not ending with the key of their parent
+	FsckBoundary     = "boundary"      // a bucket the chunker would have split differently
+	FsckCommit       = "commit"        // a commit behind a ref that is missing, doesn't decode or doesn't hash to its key
+)
+
+// FsckReport is the outcome of Fsck. Orphans are nodes no generation or ref
+// refers to; they waste space but are not corruption.
+type FsckReport struct {
+	Generations []FsckGeneration `json:"generations"`
+	Refs        []Ref            `json:"refs"`
+	Nodes       int              `json:"nodes"`
+	Reachable   int              `json:"reachable"`
+	Orphans     []Hash           `json:"orphans"`
+	Problems    []FsckProblem    `json:"problems"`
+}
+
+type FsckGeneration struct {
+	Gen  int  `json:"gen"`
+	Root Hash `json:"root"`
+}
+
+// FsckProblem is a single inconsistency. Gen, or Ref, is the first generation
+// or ref that reaches the node; nodes shared by several of them are checked
+// once.
+type FsckProblem struct {
+	Kind    string `json:"kind"`
+	Gen     int    `json:"gen"`
+	Ref     string `json:"ref,omitempty"`
+	Node    *Hash  `json:"node,omitempty"`
+	Message string `json:"message"`
+}
+
+func (r *FsckReport) OK() bool { return len(r.Problems) == 0 }
+
+// problem reports a problem of the generation or ref of at.
+func (r *FsckReport) problem(kind string, at FsckProblem, node *Hash, format string, args ...any) {
+	at.Kind, at.Node, at.Message = kind, node, fmt.Sprintf(format, args...)
+	r.Problems = append(r.Problems, at)
+}
+
+type fsck struct {
+	kv      KV
+	report  *FsckReport
+	visited map[Hash]*StoredNode // nil for nodes that are missing or broken
+	commits map[Hash]bool
+}
+
+// Fsck checks every generation and ref stored in kv by SerializeWithKids or
+// SerializeRef: that all nodes reachable from their roots are stored, decode
+// and hash to the hash they are stored under, that kids are one level below
+// their parent and in key order, and that every bucket ends exactly where the
+// chunker of the tree puts a boundary. Refs pointing at commits have every
+// commit behind them checked along with its tree. Stored nodes no root reaches
+// are listed as orphans. The error is only set when kv itself fails.
+func Fsck(kv KV) (*FsckReport, error) {
+	c := &fsck{kv: kv, report: &FsckReport{Refs: []Ref{}, Orphans: []Hash{}, Problems: []FsckProblem{}}, visited: map[Hash]*StoredNode{}, commits: map[Hash]bool{}}
+	var nodes []Hash
+	cursor := kv.Cursor()
+	for cursor.Goto(nil); cursor.Key() != nil; cursor.Next() {
+		key := cursor.Key()
+		hash, isNode := DecodeKeyWithKids(key)
+		switch {
+		case bytes.HasPrefix(key, []byte(RootPrefix)):
+			if err := c.checkGeneration(key, cursor.Value()); err != nil {
+				return nil, err
+			}
+		case bytes.HasPrefix(key, []byte(RefPrefix)):
+			if err := c.checkRef(key, cursor.Value()); err != nil {
+				return nil, err
+			}
+		case isNode:
+			nodes = append(nodes, hash)
+		}
+	}
+	for _, hash := range nodes {
+		if _, ok := c.visited[hash]; !ok {
+			c.report.Orphans = append(c.report.Orphans, hash)
+		}
+	}
+	c.report.Nodes = len(nodes)
+	c.report.Reachable = len(nodes) - len(c.report.Orphans)
+	return c.report, nil
+}
+
+func (c *fsck) checkGeneration(key []byte, value []byte) error {
+	gen, err := strconv.Atoi(strings.TrimPrefix(string(key), RootPrefix))
+	if err != nil {
+		c.report.problem(FsckBadRoot, FsckProblem{}, nil, "%q: %v", key, err)
+		return nil
+	}
+	at := FsckProblem{Gen: gen}
+	root, err := HashFromBytes(value)
+	if err != nil {
+		c.report.problem(FsckBadRoot, at, nil, "%q: %v", key, err)
+		return nil
+	}
+	c.report.Generations = append(c.report.Generations, FsckGeneration{Gen: gen, Root: root})
+	if dangling, err := c.dangling(at, root); dangling || err != nil {
+		return err
+	}
+	config, err := loadConfig(gen, c.kv)
+	if err != nil {
+		c.report.problem(FsckConfig, at, nil, "%v", err)
+		return nil
+	}
+	return c.checkTree(at, config, root)
+}
+
+func (c *fsck) checkRef(key []byte, value []byte) error {
+	name := strings.TrimPrefix(string(key), RefPrefix)
+	at := FsckProblem{Ref: name}
+	if err := checkRefName(name); err != nil {
+		c.report.problem(FsckBadRoot, at, nil, "%v", err)
+		return nil
+	}
+	root, err := HashFromBytes(value)
+	if err != nil {
+		c.report.problem(FsckBadRoot, at, nil, "%q: %v", key, err)
+		return nil
+	}
+	c.report.Refs = append(c.report.Refs, Ref{Name: name, Root: root})
+	isCommit, err := NewHistory(c.kv).IsCommit(root)
+	if err != nil {
+		return err
+	}
+	if isCommit {
+		return c.checkHistory(at, root)
+	}
+	return c.checkRoot(at, root)
+}
+
+// checkRoot checks the tree of root with the config stored for it.
+func (c *fsck) checkRoot(at FsckProblem, root Hash) error {
+	if dangling, err := c.dangling(at, root); dangling || err != nil {
+		return err
+	}
+	config, err := loadRootConfig(root, c.kv)
+	if err != nil {
+		c.report.problem(FsckConfig, at, nil, "%v", err)
+		return nil
+	}
+	return c.checkTree(at, config, root)
+}
+
+// checkHistory checks the commits behind head that no other ref reached
+// before, and their trees.
+func (c *fsck) checkHistory(at FsckProblem, head Hash) error {
+	history := NewHistory(c.kv)
+	queue := []Hash{head}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if c.commits[hash] {
+			continue
+		}
+		c.commits[hash] = true
+		commit, err := history.Get(hash)
+		if errors.Is(err, ErrCommitFormat) {
+			c.report.problem(FsckCommit, at, &hash, "%v", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.checkRoot(at, commit.Root); err != nil {
+			return err
+		}
+		queue = append(queue, commit.Parents...)
+	}
+	return nil
+}
+
+// dangling reports root when its node isn't stored. There is nothing below
+// such a root to check, so its config isn't needed either.
+func (c *fsck) dangling(at FsckProblem, root Hash) (bool, error) {
+	if _, seen := c.visited[root]; seen {
+		return false, nil
+	}
+	_, found, err := c.kv.Get(EncodeKeyWithKids(root))
+	if err != nil || found {
+		return false, err
+	}
+	c.visited[root] = nil
+	c.report.problem(FsckDanglingRoot, at, &root, "node %s not found", root)
+	return true, nil
+}
+
+// checkTree checks the nodes below root that no other root reached before.
+func (c *fsck) checkTree(at FsckProblem, config *TreeConfig, root Hash) error {
+	if _, seen := c.visited[root]; seen {
+		return nil
+	}
+	n, err := c.node(at, config, root, FsckDanglingRoot)
+	if err != nil || n == nil {
+		return err
+	}
+	if !n.tail {
+		c.report.problem(FsckOrder, at, &n.hash, "root is not a tail")
+	}
+	queue := []*StoredNode{n}
+	for len(queue) > 0 {
+		n, queue = queue[0], queue[1:]
+		kids, err := c.checkKids(at, config, n)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, kids...)
+	}
+	return nil
+}
+
+// node reads, decodes and hashes the node stored under hash. It returns nil
+// when the node is broken or missing; the latter is reported as a problem of
+// the given kind.
+func (c *fsck) node(at FsckProblem, config *TreeConfig, hash Hash, missing string) (*StoredNode, error) {
+	c.visited[hash] = nil
+	value, found, err := c.kv.Get(EncodeKeyWithKids(hash))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		c.report.problem(missing, at, &hash, "node %s not found", hash)
+		return nil, nil
+	}
+	n, err := decodeStoredNode(hash, value)
+	if err != nil {
+		c.report.problem(FsckDecode, at, &hash, "%v", err)
+		return nil, nil
+	}
+	if computed := n.computeHash(config.Hasher); computed != hash {
+		c.report.problem(FsckHash, at, &hash, "level %d node %s hashes to %s", n.level, hash, computed)
+	}
+	c.visited[hash] = n
+	return n, nil
+}
+
+// checkKids checks the bucket of n and returns the kids not visited before.
+func (c *fsck) checkKids(at FsckProblem, config *TreeConfig, n *StoredNode) ([]*StoredNode, error) {
+	if n.level == 0 {
+		return nil, nil
+	}
+	if len(n.kids) == 0 {
+		c.report.problem(FsckLevel, at, &n.hash, "level %d node has no kids", n.level)
+		return nil, nil
+	}
+	var fresh []*StoredNode
+	var prev *StoredNode
+	var chunk ChunkStats
+	sized := true // false once a missing kid leaves the size of the chunk unknown
+	for i, hash := range n.kids {
+		kid, seen := c.visited[hash]
+		if !seen {
+			var err error
+			if kid, err = c.node(at, config, hash, FsckMissingNode); err != nil {
+				return nil, err
+			}
+			if kid != nil {
+				fresh = append(fresh, kid)
+			}
+		}
+		if kid == nil {
+			prev, chunk, sized = nil, ChunkStats{}, false
+			continue
+		}
+		if kid.level != n.level-1 {
+			c.report.problem(FsckLevel, at, &n.hash, "level %d node has a kid %s at level %d", n.level, hash, kid.level)
+		}
+		last := i == len(n.kids)-1
+		if prev != nil && (prev.tail || kid.compareTo(prev.key) <= 0) {
+			c.report.problem(FsckOrder, at, &n.hash, "kid %s is not after %s", hash, prev.hash)
+		}
+		if last && (kid.tail != n.tail || !kid.tail && !bytes.Equal(kid.key, n.key)) {
+			c.report.problem(FsckOrder, at, &n.hash, "last kid %s doesn't carry the key of its parent", hash)
+		}
+		chunk.Entries++
+		chunk.Bytes += EncodedSizeWithKids(len(kid.kids), kid.key, kid.value)
+		boundary := kid.tail || config.Chunker.IsBoundary(hash, chunk)
+		switch {
+		case !sized:
+			// the decisions past a missing kid can't be checked
+		case boundary && !last:
+			c.report.problem(FsckBoundary, at, &n.hash, "kid %d of %d is a boundary for %s", i+1, len(n.kids), config.Chunker.Name())
+		case !boundary && last:
+			c.report.problem(FsckBoundary, at, &n.hash, "last kid is not a boundary for %s", config.Chunker.Name())
+		}
+		prev = kid
+	}
+	return fresh, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fsckKinds(t *testing.T, kv KV) []string {
+	report, err := Fsck(kv)
+	require.Nil(t, err)
+	var kinds []string
+	for _, p := range report.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	return kinds
+}
+
+// storeNode writes a node with the given kids, in ascending order, under the
+// hash of its content.
+func storeNode(t *testing.T, kv KV, level int8, tail bool, kids []Hash, key string) Hash {
+	n := &StoredNode{level: level, tail: tail, kids: kids, key: []byte(key)}
+	hash := n.computeHash(DefaultHasher)
+	descending := make([]Hash, len(kids))
+	for i, kid := range kids {
+		descending[len(kids)-1-i] = kid
+	}
+	require.Nil(t, kv.Set(EncodeKeyWithKids(hash), EncodeValueWithKids(level, tail, descending, []byte(key), nil)))
+	return hash
+}
+
+func TestFsck(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	t1 := NewTree(generate1(100), withChunker(FanoutChunker(4)))
+	require.Nil(t, t1.SerializeWithKids(1, kv))
+	t2 := t1.Clone()
+	t2.Put([]byte("new"), []byte("entry"))
+	require.Nil(t, t2.SerializeWithKids(2, kv))
+
+	report, err := Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%v", report.Problems)
+	require.Equal(t, []FsckGeneration{{1, t1.Root().merkleHash}, {2, t2.Root().merkleHash}}, report.Generations)
+	require.Empty(t, report.Orphans)
+	require.Equal(t, report.Nodes, report.Reachable)
+
+	// the nodes only the dropped generation refers to become orphans
+	require.Nil(t, kv.Set([]byte("root:2"), t1.Root().merkleHash[:]))
+	report, err = Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, report.OK())
+	require.NotEmpty(t, report.Orphans)
+	require.Equal(t, report.Nodes, report.Reachable+len(report.Orphans))
+	require.Nil(t, kv.Set([]byte("root:2"), t2.Root().merkleHash[:]))
+
+	// a chunker that doesn't match the stored buckets
+	config, _, err := kv.Get([]byte(configKey(1)))
+	require.Nil(t, err)
+	wrong, err := json.Marshal(withChunker(FanoutChunker(8)))
+	require.Nil(t, err)
+	require.Nil(t, kv.Set([]byte(configKey(1)), wrong))
+	require.Contains(t, fsckKinds(t, kv), FsckBoundary)
+	require.Nil(t, kv.Set([]byte(configKey(1)), config))
+
+	// a partial write of a leaf
+	leaf := t1.levels[0].tail.left
+	value, _, err := kv.Get(leaf.KeyWithKids())
+	require.Nil(t, err)
+	require.Nil(t, kv.Set(leaf.KeyWithKids(), value[:len(value)-1]))
+	require.Equal(t, []string{FsckHash}, fsckKinds(t, kv))
+	require.Nil(t, kv.Set(leaf.KeyWithKids(), value[:3]))
+	require.Equal(t, []string{FsckDecode}, fsckKinds(t, kv))
+	require.Nil(t, kv.Set(leaf.KeyWithKids(), value))
+
+	var missing Hash
+	missing[0] = 1
+	require.Nil(t, kv.Set([]byte("root:3"), missing[:]))
+	require.Nil(t, kv.Set([]byte("root:x"), missing[:]))
+	require.Nil(t, kv.Set([]byte("root:4"), missing[:5]))
+	require.ElementsMatch(t, []string{FsckDanglingRoot, FsckBadRoot, FsckBadRoot}, fsckKinds(t, kv))
+}
+
+func TestFsckStructure(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	config, err := json.Marshal(DefaultTreeConfig())
+	require.Nil(t, err)
+	require.Nil(t, kv.Set([]byte(HasherKey), []byte(DefaultHasher.Name())))
+	require.Nil(t, kv.Set([]byte(configKey(1)), config))
+	leaf := func(key string) Hash {
+		n := &StoredNode{key: []byte(key), value: []byte(key)}
+		hash := n.computeHash(DefaultHasher)
+		require.Nil(t, kv.Set(EncodeKeyWithKids(hash), EncodeValueWithKids(0, false, nil, n.key, n.value)))
+		return hash
+	}
+	tail := storeNode(t, kv, 0, true, nil, "")
+	a, b := leaf("a"), leaf("b")
+	var missing Hash
+	missing[0] = 1
+
+	setRoot := func(root Hash) {
+		require.Nil(t, kv.Set([]byte("root:1"), root[:]))
+	}
+	setRoot(storeNode(t, kv, 1, true, []Hash{b, a, tail}, ""))
+	require.Contains(t, fsckKinds(t, kv), FsckOrder)
+
+	setRoot(storeNode(t, kv, 1, true, []Hash{a, b}, ""))
+	require.Contains(t, fsckKinds(t, kv), FsckOrder)
+
+	setRoot(storeNode(t, kv, 2, true, []Hash{a, tail}, ""))
+	require.Contains(t, fsckKinds(t, kv), FsckLevel)
+
+	setRoot(storeNode(t, kv, 1, true, []Hash{a, missing, tail}, ""))
+	require.Contains(t, fsckKinds(t, kv), FsckMissingNode)
+
+	setRoot(storeNode(t, kv, 1, false, []Hash{a}, "a"))
+	require.Contains(t, fsckKinds(t, kv), FsckOrder)
+}
+
+// A kid missing in the middle of a bucket is the only problem reported, even
+// for a chunker that counts the kids before a boundary.
+func TestFsckMissingKid(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	tree := NewTree(generate1(9), withChunker(LimitChunker{Chunker: ThresholdChunker{}, MaxEntries: 3}))
+	require.Nil(t, tree.SerializeWithKids(1, kv))
+	first := tree.levels[0].tail
+	for first.left != nil {
+		first = first.left
+	}
+	require.False(t, first.right.IsBoundary())
+	require.Nil(t, kv.Delete(first.right.KeyWithKids()))
+	require.Equal(t, []string{FsckMissingNode}, fsckKinds(t, kv))
+}
+
+func TestFsckCommand(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewKVFileAt(dir)
+	require.Nil(t, NewTree(generate1(50), nil).SerializeWithKids(1, kv))
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, run([]string{"fsck", "-dir", dir}, &stdout, &stderr), stderr.String())
+	var report FsckReport
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.True(t, report.OK())
+	require.Len(t, report.Generations, 1)
+
+	var missing Hash
+	require.Nil(t, kv.Set([]byte("root:2"), missing[:]))
+	stdout.Reset()
+	require.Equal(t, 1, run([]string{"fsck", "-dir", dir}, &stdout, &stderr))
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.Equal(t, FsckDanglingRoot, report.Problems[0].Kind)
+	require.Equal(t, missing, *report.Problems[0].Node)
+
+	require.Equal(t, 2, run([]string{"fsck", "-dir", dir + "/nope"}, &stdout, &stderr))
+	require.Equal(t, 2, run([]string{"nope"}, &stdout, &stderr))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GCReport is the outcome of GC. In a dry run nothing is deleted and the
+// counts tell what a real run would reclaim.
+type GCReport struct {
+	DryRun  bool  `json:"dry_run"`
+	Kept    []int `json:"kept"`
+	Dropped []int `json:"dropped"`
+	Refs    int   `json:"refs"`
+	Marked  int   `json:"marked"`
+	Swept   int   `json:"swept"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// storedRoots returns the root hash of every generation in kv.
+func storedRoots(kv KV) (map[int]Hash, error) {
+	roots := map[int]Hash{}
+	cursor := kv.Cursor()
+	for cursor.Goto([]byte(RootPrefix)); bytes.HasPrefix(cursor.Key(), []byte(RootPrefix)); cursor.Next() {
+		key := cursor.Key()
+		gen, err := strconv.Atoi(strings.TrimPrefix(string(key), RootPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", key, err)
+		}
+		roots[gen], err = HashFromBytes(cursor.Value())
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", key, err)
+		}
+	}
+	return roots, nil
+}
+
+// GC drops every generation not in keep and deletes the nodes that neither the
+// kept generations nor any ref reach. A ref pointing at a commit keeps its
+// whole history: every commit behind it and their trees. It refuses to run
+// when a kept generation or a ref is missing or broken, since the nodes below
+// a broken node can't be marked. Nodes written while GC runs may be swept, so
+// it must not run concurrently with SerializeWithKids or SerializeRef.
+func GC(kv KV, keep []int, dryRun bool) (*GCReport, error) {
+	roots, err := storedRoots(kv)
+	if err != nil {
+		return nil, err
+	}
+	report := &GCReport{DryRun: dryRun, Kept: []int{}, Dropped: []int{}}
+	marked := map[Hash]bool{}
+	for _, gen := range keep {
+		root, ok := roots[gen]
+		if !ok {
+			return nil, fmt.Errorf("generation %d not found", gen)
+		}
+		if err := mark(kv, root, marked, IntegrityError{Gen: gen}); err != nil {
+			return nil, err
+		}
+	}
+	refs, err := NewRefs(kv).List()
+	if err != nil {
+		return nil, err
+	}
+	commits := map[Hash]bool{}
+	for _, ref := range refs {
+		if err := markRef(kv, ref, marked, commits); err != nil {
+			return nil, err
+		}
+	}
+	report.Refs = len(refs)
+	report.Marked = len(marked)
+
+	dropped := map[string]bool{}
+	for gen := range roots {
+		if slices.Contains(keep, gen) {
+			report.Kept = append(report.Kept, gen)
+		} else {
+			report.Dropped = append(report.Dropped, gen)
+			for _, key := range generationKeys(gen) {
+				dropped[key] = true
+			}
+		}
+	}
+	slices.Sort(report.Kept)
+	slices.Sort(report.Dropped)
+
+	var generations, nodes [][]byte
+	cursor := kv.Cursor()
+	for cursor.Goto(nil); cursor.Key() != nil; cursor.Next() {
+		key := cursor.Key()
+		hash, isNode := DecodeKeyWithKids(key)
+		switch {
+		case dropped[string(key)]:
+			generations = append(generations, slices.Clone(key))
+		case isNode && !marked[hash]:
+			nodes = append(nodes, slices.Clone(key))
+			report.Swept++
+		case isUnmarkedRootConfig(key, marked) || isUnmarkedCommit(key, commits):
+			nodes = append(nodes, slices.Clone(key))
+		default:
+			continue
+		}
+		report.Bytes += int64(len(cursor.Value()))
+	}
+	if dryRun {
+		return report, nil
+	}
+	// Generations go first, so that an interrupted run leaves orphans behind
+	// rather than dangling roots.
+	for _, key := range slices.Concat(generations, nodes) {
+		if err := kv.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// isUnmarkedRootConfig tells whether key is the config of a root that is no
+// longer reachable.
+func isUnmarkedRootConfig(key []byte, marked map[Hash]bool) bool {
+	hex, ok := bytes.CutPrefix(key, []byte("config:"))
+	if !ok {
+		return false
+	}
+	root, err := ParseHash(string(hex))
+	return err == nil && !marked[root]
+}
+
+// isUnmarkedCommit tells whether key is a commit no ref reaches.
+func isUnmarkedCommit(key []byte, commits map[Hash]bool) bool {
+	hash, ok := bytes.CutPrefix(key, []byte(CommitPrefix))
+	return ok && len(hash) == HashSize && !commits[Hash(hash)]
+}
+
+// markRef marks the tree ref points at, or every commit behind the commit it
+// points at along with their trees.
+func markRef(kv KV, ref Ref, marked map[Hash]bool, commits map[Hash]bool) error {
+	history := NewHistory(kv)
+	isCommit, err := history.IsCommit(ref.Root)
+	if err != nil {
+		return err
+	}
+	if !isCommit {
+		return mark(kv, ref.Root, marked, IntegrityError{Ref: ref.Name})
+	}
+	if commits[ref.Root] {
+		return nil
+	}
+	ancestors, err := history.ancestors(ref.Root)
+	if err != nil {
+		return fmt.Errorf("ref %s: %w", ref.Name, err)
+	}
+	for hash, c := range ancestors {
+		commits[hash] = true
+		if err := mark(kv, c.Root, marked, IntegrityError{Ref: ref.Name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mark adds every node reachable from root to marked. Errors are reported at
+// the generation or ref of at.
+func mark(kv KV, root Hash, marked map[Hash]bool, at IntegrityError) error {
+	hashes := []Hash{root}
+	for len(hashes) > 0 {
+		hash := hashes[len(hashes)-1]
+		hashes = hashes[:len(hashes)-1]
+		if marked[hash] {
+			continue
+		}
+		value, found, err := kv.Get(EncodeKeyWithKids(hash))
+		if err != nil {
+			return err
+		}
+		if !found {
+			at.Hash, at.Err = hash, ErrNodeMissing
+			return &at
+		}
+		_, _, kids, _, _, err := DecodeValueWithKids(value)
+		if err != nil {
+			at.Hash, at.Err = hash, err
+			return &at
+		}
+		marked[hash] = true
+		hashes = append(hashes, kids...)
+	}
+	return nil
+}
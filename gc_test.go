@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	trees := []*Tree{NewTree(generate1(100), nil)}
+	for i := range 2 {
+		next := trees[i].Clone()
+		next.Delete([]byte("1"))
+		next.Put([]byte(fmt.Sprintf("gen%d", i+2)), []byte("x"))
+		trees = append(trees, next)
+	}
+	for i, tree := range trees {
+		require.Nil(t, tree.SerializeWithKids(i+1, kv))
+	}
+
+	dry, err := GC(kv, []int{2, 3}, true)
+	require.Nil(t, err)
+	require.Equal(t, []int{2, 3}, dry.Kept)
+	require.Equal(t, []int{1}, dry.Dropped)
+	require.Positive(t, dry.Swept)
+	require.Positive(t, dry.Bytes)
+	report, err := Fsck(kv)
+	require.Nil(t, err)
+	require.Len(t, report.Generations, 3)
+
+	done, err := GC(kv, []int{2, 3}, false)
+	require.Nil(t, err)
+	dry.DryRun = false
+	require.Equal(t, dry, done)
+
+	report, err = Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%v", report.Problems)
+	require.Empty(t, report.Orphans)
+	require.Len(t, report.Generations, 2)
+	require.Equal(t, report.Nodes, done.Marked)
+	for _, gen := range []int{2, 3} {
+		loaded, err := DeserializeWithKidsVerified(gen, kv)
+		require.Nil(t, err)
+		require.Equal(t, trees[gen-1].Root().merkleHash, loaded.Root().merkleHash)
+	}
+	_, found, err := kv.Get([]byte(configKey(1)))
+	require.Nil(t, err)
+	require.False(t, found)
+
+	again, err := GC(kv, []int{2, 3}, false)
+	require.Nil(t, err)
+	require.Zero(t, again.Swept)
+	require.Zero(t, again.Bytes)
+
+	_, err = GC(kv, []int{1}, false)
+	require.Error(t, err)
+
+	// nothing is deleted when a kept generation is broken
+	leaf := trees[2].levels[0].tail.left
+	require.Nil(t, kv.Delete(leaf.KeyWithKids()))
+	require.Nil(t, kv.Delete(leaf.KeyWithKids()))
+	_, err = GC(kv, []int{3}, false)
+	var integrity *IntegrityError
+	require.ErrorAs(t, err, &integrity)
+	require.ErrorIs(t, err, ErrNodeMissing)
+	require.Equal(t, leaf.merkleHash, integrity.Hash)
+	report, err = Fsck(kv)
+	require.Nil(t, err)
+	require.Len(t, report.Generations, 2)
+}
+
+func TestGCCommand(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewKVFileAt(dir)
+	require.Nil(t, NewTree(generate1(50), nil).SerializeWithKids(1, kv))
+	require.Nil(t, NewTree(generate1(60), nil).SerializeWithKids(2, kv))
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, run([]string{"gc", "-dir", dir, "-keep", "2", "-dry-run"}, &stdout, &stderr), stderr.String())
+	var report GCReport
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.True(t, report.DryRun)
+	require.Equal(t, []int{1}, report.Dropped)
+	require.Positive(t, report.Bytes)
+	_, found, err := kv.Get([]byte(rootKey(1)))
+	require.Nil(t, err)
+	require.True(t, found)
+
+	stdout.Reset()
+	require.Equal(t, 0, run([]string{"gc", "-dir", dir, "-keep", "2"}, &stdout, &stderr), stderr.String())
+	_, found, err = kv.Get([]byte(rootKey(1)))
+	require.Nil(t, err)
+	require.False(t, found)
+
+	require.Equal(t, 2, run([]string{"gc", "-dir", dir}, &stdout, &stderr))
+	require.Equal(t, 2, run([]string{"gc", "-dir", dir, "-keep", "x"}, &stdout, &stderr))
+	require.Equal(t, 2, run([]string{"gc", "-dir", dir, "-keep", "1"}, &stdout, &stderr))
+}
+
+// A key that is as long as a hash is not mistaken for a node.
+func TestGCKeepsHashSizedKeys(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	name := "heads/abcdefghijklmnopqrstuv"
+	require.Len(t, RefPrefix+name, HashSize)
+	tree := NewTree(generate1(20), nil)
+	require.Nil(t, tree.SerializeWithKids(1, kv))
+	require.Nil(t, tree.SerializeRef(name, Hash{}, kv))
+
+	report, err := GC(kv, []int{1}, false)
+	require.Nil(t, err)
+	require.Zero(t, report.Swept)
+	ref, err := NewRefs(kv).Get(name)
+	require.Nil(t, err)
+	require.Equal(t, tree.Root().merkleHash, ref)
+}
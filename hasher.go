@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+)
+
+// Hash is a merkle hash. It is kept in binary everywhere and only hex encoded
+// for people: in Dot output, JSON and the command line.
+type Hash [HashSize]byte
+
+func (h Hash) String() string { return hex.EncodeToString(h[:]) }
+func (h Hash) IsZero() bool   { return h == Hash{} }
+
+func (h Hash) MarshalText() ([]byte, error) { return []byte(h.String()), nil }
+
+func (h *Hash) UnmarshalText(text []byte) (err error) {
+	*h, err = ParseHash(string(text))
+	return err
+}
+
+// ParseHash decodes the hex form produced by Hash.String.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if len(s) != 2*HashSize {
+		return h, fmt.Errorf("hash must be %d hex characters: %q", 2*HashSize, s)
+	}
+	_, err := hex.Decode(h[:], []byte(s))
+	return h, err
+}
+
+// HashFromBytes converts a raw digest read from storage.
+func HashFromBytes(b []byte) (Hash, error) {
+	var h Hash
+	if len(b) != HashSize {
+		return h, fmt.Errorf("hash must be %d bytes, got %d", HashSize, len(b))
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// Hasher computes the merkle hashes of a tree. Digests may be at most
+// MaxDigestSize bytes; shorter ones are padded with zeros so that every
+// hasher shares the same storage format.
+type Hasher interface {
+	Name() string
+	Size() int
+	Sum(data []byte) []byte
+}
+
+const MaxDigestSize = HashSize
+
+var DefaultHasher Hasher = SHA256Hasher{}
+
+type SHA256Hasher struct{}
+
+func (SHA256Hasher) Name() string { return "sha256" }
+func (SHA256Hasher) Size() int    { return sha256.Size }
+func (SHA256Hasher) Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+type SHA512_256Hasher struct{}
+
+func (SHA512_256Hasher) Name() string { return "sha512/256" }
+func (SHA512_256Hasher) Size() int    { return sha512.Size256 }
+func (SHA512_256Hasher) Sum(data []byte) []byte {
+	sum := sha512.Sum512_256(data)
+	return sum[:]
+}
+
+// FNVHasher is a fast non-cryptographic hasher for datasets that don't need
+// to resist deliberately crafted collisions.
+type FNVHasher struct{}
+
+func (FNVHasher) Name() string { return "fnv128a" }
+func (FNVHasher) Size() int    { return 16 }
+func (FNVHasher) Sum(data []byte) []byte {
+	h := fnv.New128a()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+var hashers = map[string]Hasher{}
+
+func init() {
+	for _, h := range []Hasher{SHA256Hasher{}, SHA512_256Hasher{}, FNVHasher{}} {
+		RegisterHasher(h)
+	}
+}
+
+// RegisterHasher makes h available to HasherByName, which is how stored trees
+// find the hasher they were written with.
+func RegisterHasher(h Hasher) {
+	mustTrue(h.Size() <= MaxDigestSize, "hasher %q digest is too long: %d", h.Name(), h.Size())
+	hashers[h.Name()] = h
+}
+
+func HasherByName(name string) (Hasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hasher: %q", name)
+	}
+	return h, nil
+}
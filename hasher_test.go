@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashers(t *testing.T) {
+	messages := generate1(300)
+	roots := map[Hash]bool{}
+	for _, name := range []string{"sha256", "sha512/256", "fnv128a"} {
+		hasher, err := HasherByName(name)
+		require.Nil(t, err)
+		require.Equal(t, name, hasher.Name())
+		require.Len(t, hasher.Sum([]byte("x")), hasher.Size())
+
+		tree := NewTree(messages, &TreeConfig{Chunker: DefaultChunker, Hasher: hasher})
+		roots[tree.Root().merkleHash] = true
+
+		// edits keep using the tree's hasher
+		edited := NewTree(messages[:200], &TreeConfig{Chunker: DefaultChunker, Hasher: hasher})
+		for _, m := range messages[200:] {
+			edited.Put(m.key, m.value)
+		}
+		require.Equal(t, tree.Root().merkleHash, edited.Root().merkleHash)
+
+		kv := NewKVFile()
+		kv.MustReset()
+		require.Nil(t, tree.SerializeWithKids(1, kv))
+		loaded, err := DeserializeWithKids(1, kv)
+		require.Nil(t, err)
+		require.Equal(t, name, loaded.Config().Hasher.Name())
+		require.Equal(t, tree.Root().merkleHash, loaded.Root().merkleHash)
+	}
+	require.Len(t, roots, 3)
+
+	_, err := HasherByName("md5")
+	require.Error(t, err)
+}
+
+func TestHasherMismatch(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	require.Nil(t, NewTree(generate1(10), &TreeConfig{Chunker: DefaultChunker, Hasher: FNVHasher{}}).SerializeWithKids(1, kv))
+	err := NewTree(generate1(20), nil).SerializeWithKids(2, kv)
+	require.ErrorIs(t, err, ErrHasherMismatch)
+
+	require.Nil(t, kv.Set([]byte(HasherKey), []byte("md5")))
+	_, err = DeserializeWithKids(1, kv)
+	require.Error(t, err)
+}
@@ -3,6 +3,12 @@ package main
 type KV interface {
 	Get(key []byte) ([]byte, bool, error)
 	Set(key []byte, value []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key []byte) error
+	// CompareAndSwap sets key to value only while it still holds old, and
+	// reports whether it did. A nil old means key must not exist, a nil value
+	// deletes key.
+	CompareAndSwap(key []byte, old []byte, value []byte) (bool, error)
 	Cursor() KVCursor
 }
 
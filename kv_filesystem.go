@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strings"
 )
 
@@ -15,16 +18,55 @@ var _ KV = &FileSystem{}
 
 var BaseDir = filepath.Join(os.TempDir(), "prollykv")
 
-func NewKVFile() *FileSystem {
+func NewKVFile() *FileSystem { return NewKVFileAt(BaseDir) }
+
+// NewKVFileAt opens the store kept in dir, creating the directory if needed.
+func NewKVFileAt(dir string) *FileSystem {
+	abs, err := filepath.Abs(dir)
+	mustNil(err)
 	this := &FileSystem{
-		dir: BaseDir,
+		dir: abs,
 	}
 	this.MustBaseDir()
 	return this
 }
 
+// fileName escapes the bytes of key that are not safe in a file name as %XX.
+// Keys hold raw hashes, so besides separators and control characters this
+// covers upper case letters, which collide on case-insensitive file systems,
+// and a leading dot.
+func fileName(key []byte) string {
+	var sb strings.Builder
+	for i, c := range key {
+		safe := 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == ':' || c == '.' && i > 0
+		if safe {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// keyOf reverses fileName. Names that were not escaped, such as files put into
+// the directory by hand, are returned as is.
+func keyOf(name string) []byte {
+	key := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			if b, err := hex.DecodeString(name[i+1 : i+3]); err == nil {
+				key = append(key, b[0])
+				i += 2
+				continue
+			}
+		}
+		key = append(key, name[i])
+	}
+	return key
+}
+
 func (kv *FileSystem) Get(key []byte) ([]byte, bool, error) {
-	path := filepath.Join(kv.dir, string(key))
+	path := filepath.Join(kv.dir, fileName(key))
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -36,10 +78,55 @@ func (kv *FileSystem) Get(key []byte) ([]byte, bool, error) {
 }
 
 func (kv *FileSystem) Set(key []byte, value []byte) error {
-	path := filepath.Join(kv.dir, string(key))
+	path := filepath.Join(kv.dir, fileName(key))
 	return os.WriteFile(path, value, 0644)
 }
 
+func (kv *FileSystem) Delete(key []byte) error {
+	path := filepath.Join(kv.dir, fileName(key))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// casLockName is the file CompareAndSwap holds a lock on, so that swaps are
+// atomic across every handle and process sharing the directory. It starts
+// with a dot, so it is not a key.
+const casLockName = ".cas-lock"
+
+func (kv *FileSystem) CompareAndSwap(key []byte, old []byte, value []byte) (bool, error) {
+	unlock, err := lockFile(filepath.Join(kv.dir, casLockName))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	current, found, err := kv.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if old == nil && found || old != nil && (!found || !bytes.Equal(current, old)) {
+		return false, nil
+	}
+	if value == nil {
+		return true, kv.Delete(key)
+	}
+	// Readers never see a partially written value.
+	tmp, err := os.CreateTemp(kv.dir, ".cas-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), filepath.Join(kv.dir, fileName(key)))
+}
+
 func (kv *FileSystem) MustCleanup() {
 	err := os.RemoveAll(kv.dir)
 	mustNil(err)
@@ -63,7 +150,7 @@ func (kv *FileSystem) Cursor() KVCursor {
 
 type FileSystemCursor struct {
 	dir   string
-	keys  []string
+	keys  [][]byte // decoded and sorted
 	index int
 }
 
@@ -74,19 +161,25 @@ func mustList(dir string) []string {
 	mustNil(err)
 	var names []string
 	for _, entry := range entries {
+		// keys never start with a dot, see fileName
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
 		names = append(names, entry.Name())
 	}
 	return names
 }
 
+// Goto moves to the first key that is greater than or equal to key. Escaping
+// doesn't preserve the order of keys, so the names are sorted once decoded.
 func (f *FileSystemCursor) Goto(key []byte) {
-	f.keys = mustList(f.dir)
-	sort.Strings(f.keys)
-	s := string(key)
-	i := sort.Search(len(f.keys), func(i int) bool {
-		return strings.HasPrefix(f.keys[i], s)
-	})
-	f.index = min(i, len(f.keys))
+	f.keys = f.keys[:0]
+	for _, name := range mustList(f.dir) {
+		f.keys = append(f.keys, keyOf(name))
+	}
+	slices.SortFunc(f.keys, bytes.Compare)
+	i, _ := slices.BinarySearchFunc(f.keys, key, bytes.Compare)
+	f.index = i
 }
 
 func (f *FileSystemCursor) Next() {
@@ -97,14 +190,14 @@ func (f *FileSystemCursor) Next() {
 
 func (f *FileSystemCursor) Key() []byte {
 	if f.index < len(f.keys) {
-		return []byte(f.keys[f.index])
+		return f.keys[f.index]
 	}
 	return nil
 }
 
 func (f *FileSystemCursor) Value() []byte {
 	if f.index < len(f.keys) {
-		path := filepath.Join(f.dir, f.keys[f.index])
+		path := filepath.Join(f.dir, fileName(f.keys[f.index]))
 		return mustSlurp(path)
 	}
 	return nil
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile creates the file at path exclusively, and waits while it exists.
+// The lock goes away with the returned unlock; a process that dies holding it
+// leaves the file behind, and it has to be removed by hand.
+func lockFile(path string) (unlock func(), err error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,6 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -36,3 +44,78 @@ func TestCursor(t *testing.T) {
 	require.Nil(t, cursor.Key())
 	require.Nil(t, cursor.Value())
 }
+
+func TestBinaryKeys(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	keys := [][]byte{{0}, {'/'}, {'.', '.'}, {'A'}, {'a'}, {'%', '4', '1'}, {0xff, 0x10}, []byte("root:1")}
+	for i, key := range keys {
+		require.Nil(t, kv.Set(key, []byte{byte(i)}))
+	}
+	for i, key := range keys {
+		value, found, err := kv.Get(key)
+		require.Nil(t, err)
+		require.True(t, found, "%q", key)
+		require.Equal(t, []byte{byte(i)}, value)
+	}
+
+	slices.SortFunc(keys, bytes.Compare)
+	cursor := kv.Cursor()
+	cursor.Goto(nil)
+	for _, key := range keys {
+		require.Equal(t, key, cursor.Key())
+		cursor.Next()
+	}
+	require.Nil(t, cursor.Key())
+}
+
+// TestCompareAndSwapProcesses has processes, and handles opened with
+// different spellings of the same directory, race to create one key. Only one
+// of them may win. The test binary runs itself for the other processes.
+func TestCompareAndSwapProcesses(t *testing.T) {
+	const key = "heads/main"
+	if dir := os.Getenv("PROLLYKV_CAS_DIR"); dir != "" {
+		swapped, err := NewKVFileAt(dir).CompareAndSwap([]byte(key), nil, []byte(dir))
+		require.Nil(t, err)
+		if swapped {
+			os.Stdout.WriteString("won\n")
+		}
+		return
+	}
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	require.Nil(t, err)
+	relative, err := filepath.Rel(cwd, dir)
+	require.Nil(t, err)
+	require.Equal(t, NewKVFileAt(dir).dir, NewKVFileAt(relative).dir)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	failures := make([]error, 8)
+	for i := range failures {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spelling := []string{dir, relative, "./" + relative, dir + "/"}[i%4]
+			var swapped bool
+			if i%2 == 0 {
+				cmd := exec.Command(os.Args[0], "-test.run=^TestCompareAndSwapProcesses$")
+				cmd.Env = append(os.Environ(), "PROLLYKV_CAS_DIR="+spelling)
+				out, err := cmd.Output()
+				failures[i] = err
+				swapped = strings.Contains(string(out), "won")
+			} else {
+				swapped, failures[i] = NewKVFileAt(spelling).CompareAndSwap([]byte(key), nil, []byte(spelling))
+			}
+			if swapped {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Nil(t, errors.Join(failures...))
+	require.Equal(t, 1, won)
+}
@@ -1,7 +1,319 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `usage: prollykv <command> [flags]
+
+commands:
+  fsck    check every generation of a store, print a JSON report
+  gc      drop all but the given generations and delete unreachable nodes
+  list    list the generations of a store
+  drop    drop a generation, leaving its nodes to gc
+  retain  apply a retention policy and delete unreachable nodes
+  refs    list the branches, tags and HEAD of a store
+  ref     show a ref, or create, move or delete it
+`
 
 func main() {
-	fmt.Println("Hello, World!")
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes a command and returns the exit status: 0 on success, 1 when
+// the store is corrupted and 2 when the command itself fails.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "fsck":
+		return runFsck(args[1:], stdout, stderr)
+	case "gc":
+		return runGC(args[1:], stdout, stderr)
+	case "list":
+		return runList(args[1:], stdout, stderr)
+	case "drop":
+		return runDrop(args[1:], stdout, stderr)
+	case "retain":
+		return runRetain(args[1:], stdout, stderr)
+	case "refs":
+		return runRefs(args[1:], stdout, stderr)
+	case "ref":
+		return runRef(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command: %q\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// openStore opens the store in dir, which must exist.
+func openStore(dir string) (*FileSystem, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+	return NewKVFileAt(dir), nil
+}
+
+func runFsck(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", BaseDir, "store directory")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	kv, err := openStore(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	report, err := Fsck(kv)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := writeJSON(stdout, report); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+func runGC(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", BaseDir, "store directory")
+	keepList := flags.String("keep", "", "comma separated generations to keep")
+	dryRun := flags.Bool("dry-run", false, "report what would be deleted without deleting it")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	keep, err := parseGenerations(*keepList)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if len(keep) == 0 {
+		fmt.Fprintln(stderr, "gc: -keep is required")
+		return 2
+	}
+	kv, err := openStore(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	report, err := GC(kv, keep, *dryRun)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := writeJSON(stdout, report); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
+
+func runList(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", BaseDir, "store directory")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	kv, err := openStore(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	gens, err := NewCatalog(kv).List()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := writeJSON(stdout, gens); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
+
+func runDrop(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("drop", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", BaseDir, "store directory")
+	gen := flags.Int("gen", -1, "generation to drop")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	kv, err := openStore(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := NewCatalog(kv).Drop(*gen); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
+
+func runRetain(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("retain", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", BaseDir, "store directory")
+	var policy RetentionPolicy
+	flags.IntVar(&policy.KeepLast, "last", 0, "keep the newest generations")
+	flags.IntVar(&policy.KeepDaily, "daily", 0, "keep the newest generation of each of the last days")
+	dryRun := flags.Bool("dry-run", false, "report what would be deleted without deleting it")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	kv, err := openStore(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	report, err := NewCatalog(kv).ApplyRetention(policy, time.Now(), *dryRun)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := writeJSON(stdout, report); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
+
+func runRefs(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("refs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", BaseDir, "store directory")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	kv, err := openStore(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	refs, err := NewRefs(kv).List()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := writeJSON(stdout, refs); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
+
+// runRef shows the ref -name, or when -to, -gen or -delete is given, updates
+// it with a compare-and-swap on -old. An empty -old creates the ref.
+func runRef(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ref", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", BaseDir, "store directory")
+	name := flags.String("name", "", "ref name, such as HEAD, heads/main or tags/v1")
+	to := flags.String("to", "", "root hash to point the ref at")
+	gen := flags.Int("gen", -1, "generation whose root to point the ref at")
+	old := flags.String("old", "", "root hash the ref must point at before the update")
+	remove := flags.Bool("delete", false, "delete the ref")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	kv, err := openStore(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	refs := NewRefs(kv)
+	if *to == "" && *gen < 0 && !*remove {
+		ref, err := refs.Resolve(*name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		if err := writeJSON(stdout, ref); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		return 0
+	}
+	var expected Hash
+	if *old != "" {
+		if expected, err = ParseHash(*old); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+	if *remove {
+		err = refs.Delete(*name, expected)
+	} else {
+		var root Hash
+		root, err = refTarget(kv, *to, *gen)
+		if err == nil {
+			err = refs.Update(*name, expected, root)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
+
+// refTarget returns the root hash given as hex in to, or the root of
+// generation gen.
+func refTarget(kv KV, to string, gen int) (Hash, error) {
+	if to != "" && gen >= 0 {
+		return Hash{}, fmt.Errorf("ref: -to and -gen are exclusive")
+	}
+	if to != "" {
+		return ParseHash(to)
+	}
+	g, err := NewCatalog(kv).Get(gen)
+	if err != nil {
+		return Hash{}, err
+	}
+	return g.Root, nil
+}
+
+// parseGenerations parses a comma separated list of generations.
+func parseGenerations(s string) ([]int, error) {
+	var gens []int
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		gen, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("bad generation: %q", field)
+		}
+		gens = append(gens, gen)
+	}
+	return gens, nil
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Proof shows that an entry is part of a tree with a known root hash. It
+// holds the bucket of every level from level0 up to the root, exactly as
+// BucketHash consumed them, and the position of the hash coming from below.
+// Hashing the entry and then every bucket in turn must end at the root. Since
+// bucket hashes cover their level, the proof only verifies with exactly one
+// bucket per level below the root.
+type Proof struct {
+	Hasher string        `json:"hasher"`
+	Levels []ProofBucket `json:"levels"`
+}
+
+// ProofBucket is one bucket on the path from a leaf to the root, in
+// ascending key order.
+type ProofBucket struct {
+	Hashes []Hash `json:"hashes"`
+	Index  int    `json:"index"`
+}
+
+var ErrProofInvalid = errors.New("invalid proof")
+
+// Prove returns the inclusion proof of key. It returns false when key is not
+// in the tree.
+func (t *Tree) Prove(key []byte) (*Proof, bool) {
+	n := t.seek(key)
+	if n.compareTo(key) != 0 {
+		return nil, false
+	}
+	return t.proofOf(n), true
+}
+
+// proofOf collects the buckets from n up to the root.
+func (t *Tree) proofOf(n *Node) *Proof {
+	proof := &Proof{Hasher: t.config.Hasher.Name()}
+	root := t.Root()
+	for p := n; p != root; {
+		boundary := p
+		for !boundary.IsBoundary() {
+			boundary = boundary.right
+		}
+		var bucket []*Node
+		boundary.UntilBoundary(func(q *Node) { bucket = append(bucket, q) })
+		slices.Reverse(bucket)
+		level := ProofBucket{Index: slices.Index(bucket, p)}
+		for _, q := range bucket {
+			level.Hashes = append(level.Hashes, q.merkleHash)
+		}
+		proof.Levels = append(proof.Levels, level)
+		p = boundary.up
+	}
+	return proof
+}
+
+// VerifyProof checks that key is stored with value in the tree whose root
+// hash is rootHash. It needs nothing but the proof.
+func VerifyProof(rootHash Hash, key []byte, value []byte, proof *Proof) error {
+	hasher, err := HasherByName(proof.Hasher)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProofInvalid, err)
+	}
+	hash, err := proof.root(hasher, LeafHash(hasher, false, key, value))
+	if err != nil {
+		return err
+	}
+	if hash != rootHash {
+		return fmt.Errorf("%w: root %s, expected %s", ErrProofInvalid, hash, rootHash)
+	}
+	return nil
+}
+
+// root hashes the buckets of the proof bottom up, starting from leaf.
+func (p *Proof) root(hasher Hasher, leaf Hash) (Hash, error) {
+	if err := checkDepth(len(p.Levels)); err != nil {
+		return Hash{}, err
+	}
+	hash := leaf
+	for i, level := range p.Levels {
+		if level.Index < 0 || level.Index >= len(level.Hashes) || level.Hashes[level.Index] != hash {
+			return Hash{}, fmt.Errorf("%w: level %d does not contain %s", ErrProofInvalid, i, hash)
+		}
+		hash = bucketHashOf(hasher, int8(i+1), level.Hashes)
+	}
+	return hash, nil
+}
+
+// checkDepth rejects proofs with no levels or more levels than a tree can
+// have.
+func checkDepth(levels int) error {
+	if levels == 0 {
+		return fmt.Errorf("%w: no levels", ErrProofInvalid)
+	}
+	if levels > math.MaxInt8 {
+		return fmt.Errorf("%w: %d levels", ErrProofInvalid, levels)
+	}
+	return nil
+}
+
+// RangeProof shows that a range [start, end) of a tree with a known root hash
+// holds exactly a given list of entries. Besides the entries it exposes their
+// neighbours in level0: Left is the last entry before start, Right is the
+// first entry at or after end. Level i holds the consecutive buckets of level
+// i that cover the exposed nodes; the nodes start at Index of the
+// concatenated buckets. Hashing the buckets of a level yields the exposed
+// nodes of the level above, so no entry can be left out between the
+// neighbours. A nil Left means the range starts at the first entry, which
+// shows as Index 0 at every level. The right side needs no such care because
+// level0 always ends with the tail. The proof for an empty tree has no
+// levels: the tail is the root.
+type RangeProof struct {
+	Hasher string       `json:"hasher"`
+	Left   *ProofEntry  `json:"left,omitempty"`
+	Right  ProofEntry   `json:"right"`
+	Levels []RangeLevel `json:"levels"`
+}
+
+// ProofEntry is a level0 node exposed by a RangeProof.
+type ProofEntry struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Tail  bool   `json:"tail,omitempty"`
+}
+
+// RangeLevel is the run of consecutive buckets of one level of a RangeProof.
+type RangeLevel struct {
+	Buckets [][]Hash `json:"buckets"`
+	Index   int      `json:"index"`
+}
+
+func proofEntryOf(n *Node) ProofEntry {
+	return ProofEntry{Key: n.key, Value: n.value, Tail: n.isTail}
+}
+
+// ProveRange returns the entries of [start, end) together with the proof
+// that there are no others. An empty end means the range is unbounded on the
+// right.
+func (t *Tree) ProveRange(start []byte, end []byte) (*RangeProof, []*Message) {
+	first := t.seek(start)
+	last := t.levels[0].tail
+	if len(end) > 0 {
+		last = t.seek(end)
+	}
+	proof := &RangeProof{Hasher: t.config.Hasher.Name(), Right: proofEntryOf(last)}
+	var entries []*Message
+	for p := first; p != last; p = p.right {
+		entries = append(entries, NewMessage(p.key, p.value))
+	}
+	lo := first
+	if first.left != nil {
+		lo = first.left
+		left := proofEntryOf(lo)
+		proof.Left = &left
+	}
+
+	root := t.Root()
+	for hi := last; lo != root; {
+		from := lo
+		for from.left != nil && !from.left.IsBoundary() {
+			from = from.left
+		}
+		to := hi
+		for !to.IsBoundary() {
+			to = to.right
+		}
+		level := RangeLevel{}
+		var bucket []Hash
+		for p, i := from, 0; ; p, i = p.right, i+1 {
+			if p == lo {
+				level.Index = i
+			}
+			bucket = append(bucket, p.merkleHash)
+			if p.IsBoundary() {
+				level.Buckets = append(level.Buckets, bucket)
+				bucket = nil
+				if p == to {
+					break
+				}
+			}
+		}
+		proof.Levels = append(proof.Levels, level)
+		for !lo.IsBoundary() {
+			lo = lo.right
+		}
+		lo, hi = lo.up, to.up
+	}
+	return proof, entries
+}
+
+// ProveAbsence returns the proof that key is not in the tree. It fails when
+// the key is there.
+func (t *Tree) ProveAbsence(key []byte) (*RangeProof, bool) {
+	proof, entries := t.ProveRange(key, pointAfter(key))
+	return proof, len(entries) == 0
+}
+
+// pointAfter returns the smallest key greater than key, so that
+// [key, pointAfter(key)) holds key alone.
+func pointAfter(key []byte) []byte {
+	return append(slices.Clone(key), 0)
+}
+
+// VerifyAbsence checks that key is not in the tree whose root hash is
+// rootHash.
+func VerifyAbsence(rootHash Hash, key []byte, proof *RangeProof) error {
+	return VerifyRangeProof(rootHash, key, pointAfter(key), nil, proof)
+}
+
+// VerifyRangeProof checks that entries, in ascending key order, are exactly
+// the entries of [start, end) in the tree whose root hash is rootHash. An
+// empty end means the range is unbounded on the right.
+func VerifyRangeProof(rootHash Hash, start []byte, end []byte, entries []*Message, proof *RangeProof) error {
+	hasher, err := HasherByName(proof.Hasher)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProofInvalid, err)
+	}
+
+	var hashes []Hash
+	if left := proof.Left; left != nil {
+		if left.Tail || bytes.Compare(left.Key, start) >= 0 {
+			return fmt.Errorf("%w: left neighbour %q is not before the range", ErrProofInvalid, left.Key)
+		}
+		hashes = append(hashes, LeafHash(hasher, false, left.Key, left.Value))
+	}
+	for i, m := range entries {
+		if !inRange(m.key, start, end) || i > 0 && bytes.Compare(entries[i-1].key, m.key) >= 0 {
+			return fmt.Errorf("%w: entry %q is out of order or outside the range", ErrProofInvalid, m.key)
+		}
+		hashes = append(hashes, LeafHash(hasher, false, m.key, m.value))
+	}
+	right := proof.Right
+	if !right.Tail && (len(end) == 0 || bytes.Compare(right.Key, end) < 0) {
+		return fmt.Errorf("%w: right neighbour %q is not after the range", ErrProofInvalid, right.Key)
+	}
+	hashes = append(hashes, LeafHash(hasher, right.Tail, right.Key, right.Value))
+
+	if len(proof.Levels) > math.MaxInt8 {
+		return fmt.Errorf("%w: %d levels", ErrProofInvalid, len(proof.Levels))
+	}
+	for i, level := range proof.Levels {
+		flat := slices.Concat(level.Buckets...)
+		if level.Index < 0 || level.Index+len(hashes) > len(flat) || !slices.Equal(flat[level.Index:level.Index+len(hashes)], hashes) {
+			return fmt.Errorf("%w: level %d does not contain the nodes below", ErrProofInvalid, i)
+		}
+		if proof.Left == nil && level.Index != 0 {
+			return fmt.Errorf("%w: level %d does not start at the first entry", ErrProofInvalid, i)
+		}
+		hashes = hashes[:0]
+		for _, bucket := range level.Buckets {
+			if len(bucket) == 0 {
+				return fmt.Errorf("%w: level %d has an empty bucket", ErrProofInvalid, i)
+			}
+			hashes = append(hashes, bucketHashOf(hasher, int8(i+1), bucket))
+		}
+	}
+	if len(hashes) != 1 || hashes[0] != rootHash {
+		return fmt.Errorf("%w: root does not match %s", ErrProofInvalid, rootHash)
+	}
+	return nil
+}
+
+// prove is Prove for a tree of stored nodes hashed with hasher.
+func (t *LazyTree) prove(hasher Hasher, key []byte) (*Proof, bool, error) {
+	it := t.Range(nil, nil)
+	if !it.position(key) {
+		return nil, false, it.Err()
+	}
+	if it.leaf.compareTo(key) != 0 {
+		return nil, false, nil
+	}
+	proof := &Proof{Hasher: hasher.Name()}
+	for _, f := range slices.Backward(it.path) {
+		proof.Levels = append(proof.Levels, ProofBucket{Hashes: f.n.kids, Index: f.i})
+	}
+	return proof, true, nil
+}
+
+// proveRange is ProveRange for a tree of stored nodes hashed with hasher.
+// The paths to the neighbours of the range tell which nodes of every level
+// are exposed: the kids of the exposed nodes of a level are the buckets of
+// the level below.
+func (t *LazyTree) proveRange(hasher Hasher, start []byte, end []byte) (*RangeProof, []*Message, error) {
+	var entries []*Message
+	it := t.Range(start, end)
+	for ok := it.First(); ok; ok = it.Next() {
+		entries = append(entries, NewMessage(it.Key(), it.Value()))
+	}
+	if it.Err() != nil {
+		return nil, nil, it.Err()
+	}
+
+	hi := t.Range(nil, nil)
+	if len(end) == 0 {
+		if n, ok := hi.reset(); ok {
+			hi.descend(n, true)
+		}
+	} else {
+		hi.position(end)
+	}
+	lo := t.Range(nil, nil)
+	lo.position(start)
+	if hi.Err() != nil || lo.Err() != nil {
+		return nil, nil, errors.Join(hi.Err(), lo.Err())
+	}
+	proof := &RangeProof{Hasher: hasher.Name(), Right: storedEntryOf(hi.leaf)}
+	first := slices.Clone(lo.path)
+	if lo.step(-1) {
+		left := storedEntryOf(lo.leaf)
+		proof.Left = &left
+	} else if lo.Err() != nil {
+		return nil, nil, lo.Err()
+	} else {
+		lo.path = first
+	}
+
+	var exposed []*StoredNode
+	if len(hi.path) > 0 {
+		exposed = []*StoredNode{hi.path[0].n}
+	}
+	proof.Levels = make([]RangeLevel, len(hi.path))
+	for d := range hi.path {
+		level := RangeLevel{Index: lo.path[d].i}
+		to := hi.path[d].i
+		for _, n := range exposed {
+			level.Buckets = append(level.Buckets, n.kids)
+			to += len(n.kids)
+		}
+		to -= len(exposed[len(exposed)-1].kids)
+		proof.Levels[len(hi.path)-1-d] = level
+		var below []*StoredNode
+		offset := 0
+		for _, n := range exposed {
+			for i := range n.kids {
+				if offset+i < level.Index || offset+i > to {
+					continue
+				}
+				kid, err := t.kid(n, i)
+				if err != nil {
+					return nil, nil, err
+				}
+				below = append(below, kid)
+			}
+			offset += len(n.kids)
+		}
+		exposed = below
+	}
+	return proof, entries, nil
+}
+
+// proveAbsence is ProveAbsence for a tree of stored nodes hashed with hasher.
+func (t *LazyTree) proveAbsence(hasher Hasher, key []byte) (*RangeProof, bool, error) {
+	proof, entries, err := t.proveRange(hasher, key, pointAfter(key))
+	return proof, len(entries) == 0, err
+}
+
+func storedEntryOf(n *StoredNode) ProofEntry {
+	return ProofEntry{Key: n.key, Value: n.value, Tail: n.tail}
+}
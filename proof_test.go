@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProve(t *testing.T) {
+	for _, config := range []*TreeConfig{
+		DefaultTreeConfig(),
+		withChunker(FanoutChunker(3)),
+		{Chunker: CDFChunker{Average: 8, K: 2}, Hasher: FNVHasher{}},
+	} {
+		messages := generate1(500)
+		tree := NewTree(messages, config)
+		root := tree.Root().merkleHash
+		for _, m := range messages {
+			proof, ok := tree.Prove(m.key)
+			require.True(t, ok)
+			require.Len(t, proof.Levels, tree.Height()-1)
+			require.Nil(t, VerifyProof(root, m.key, m.value, proof))
+			require.ErrorIs(t, VerifyProof(root, m.key, []byte("forged"), proof), ErrProofInvalid)
+			require.ErrorIs(t, VerifyProof(root, []byte("forged"), m.value, proof), ErrProofInvalid)
+		}
+		_, ok := tree.Prove([]byte("missing"))
+		require.False(t, ok)
+	}
+}
+
+func TestVerifyProofTampered(t *testing.T) {
+	messages := generate1(300)
+	tree := NewTree(messages, nil)
+	root := tree.Root().merkleHash
+	key, value := messages[42].key, messages[42].value
+	proof, ok := tree.Prove(key)
+	require.True(t, ok)
+
+	// proofs travel as JSON
+	data, err := json.Marshal(proof)
+	require.Nil(t, err)
+	decode := func() *Proof {
+		var p Proof
+		require.Nil(t, json.Unmarshal(data, &p))
+		return &p
+	}
+	require.Nil(t, VerifyProof(root, key, value, decode()))
+
+	// a newer snapshot has a different root
+	tree.Put([]byte("new"), []byte("entry"))
+	require.ErrorIs(t, VerifyProof(tree.Root().merkleHash, key, value, decode()), ErrProofInvalid)
+
+	p := decode()
+	p.Levels[1].Hashes[0][0] ^= 1
+	require.ErrorIs(t, VerifyProof(root, key, value, p), ErrProofInvalid)
+
+	p = decode()
+	p.Levels[0].Index = len(p.Levels[0].Hashes)
+	require.ErrorIs(t, VerifyProof(root, key, value, p), ErrProofInvalid)
+
+	p = decode()
+	p.Levels = p.Levels[:len(p.Levels)-1]
+	require.ErrorIs(t, VerifyProof(root, key, value, p), ErrProofInvalid)
+
+	p = decode()
+	p.Hasher = "fnv128a"
+	require.ErrorIs(t, VerifyProof(root, key, value, p), ErrProofInvalid)
+
+	p = decode()
+	p.Hasher = "md5"
+	require.ErrorIs(t, VerifyProof(root, key, value, p), ErrProofInvalid)
+
+	require.ErrorIs(t, VerifyProof(root, key, value, &Proof{Hasher: "sha256"}), ErrProofInvalid)
+}
+
+// forgeableTree returns a tree whose first level1 node has kids that, taken
+// as bytes, also read as the encoding of a leaf, together with the key and
+// value of that fake leaf. Buckets hold two entries, and the value of the
+// first entry is picked so that its hash starts like a leaf: notTailFlag, then
+// a short key length.
+func forgeableTree(t *testing.T) (*Tree, *Node, []byte, []byte) {
+	config := withChunker(LimitChunker{Chunker: ThresholdChunker{Threshold: 0}, MaxEntries: 2})
+	for i := 0; ; i++ {
+		messages := []*Message{}
+		for j := range 8 {
+			messages = append(messages, NewMessage([]byte{0, byte(j + 1)}, []byte(strconv.Itoa(i))))
+		}
+		tree := NewTree(messages, config)
+		first := tree.levels[0].tail
+		for first.left != nil {
+			first = first.left
+		}
+		hash := first.merkleHash
+		if hash[0] != notTailFlag || hash[1] == 0 || hash[1] > HashSize || hash[2] == 0 {
+			continue
+		}
+		n := first
+		for !n.IsBoundary() {
+			n = n.right
+		}
+		var kids []byte
+		n.up.Kids(func(kid *Node) { kids = append(kid.merkleHash[:], kids...) })
+		keyEnd := 2 + int(hash[1])
+		return tree, n.up, kids[2:keyEnd], kids[keyEnd:]
+	}
+}
+
+// TestProveForgedLeaf passes a level1 node off as a leaf whose encoding is the
+// concatenation of its kids.
+func TestProveForgedLeaf(t *testing.T) {
+	tree, node, key, value := forgeableTree(t)
+	root := tree.Root().merkleHash
+	_, found := tree.Get(key)
+	require.False(t, found)
+	require.ErrorIs(t, VerifyProof(root, key, value, tree.proofOf(node)), ErrProofInvalid)
+}
+
+// TestProveRangeForgedLeaf hides the entries below a level1 node by passing
+// the node off as the right neighbour of a range.
+func TestProveRangeForgedLeaf(t *testing.T) {
+	tree, _, key, value := forgeableTree(t)
+	root := tree.Root().merkleHash
+	first := []byte{0, 1}
+	proof, ok := tree.ProveAbsence(first)
+	require.False(t, ok)
+	forged := *proof
+	forged.Right = ProofEntry{Key: key, Value: value}
+	forged.Levels = proof.Levels[1:]
+	require.ErrorIs(t, VerifyAbsence(root, first, &forged), ErrProofInvalid)
+	require.ErrorIs(t, VerifyRangeProof(root, []byte{0}, []byte{0, 5}, nil, &forged), ErrProofInvalid)
+	forged.Levels = slices.Repeat(proof.Levels[1:], 200)
+	require.ErrorIs(t, VerifyAbsence(root, first, &forged), ErrProofInvalid)
+}
+
+func TestProveRange(t *testing.T) {
+	for _, config := range []*TreeConfig{DefaultTreeConfig(), withChunker(FanoutChunker(3))} {
+		messages := generate1(400)
+		tree := NewTree(messages, config)
+		root := tree.Root().merkleHash
+		ranges := [][2]string{
+			{"", ""}, {"", "2"}, {"100", "200"}, {"150", "151"}, {"55", "56"},
+			{"99", ""}, {"999", ""}, {"a", "b"}, {"0", "1"}, {"1", "10"},
+		}
+		for _, r := range ranges {
+			start, end := []byte(r[0]), []byte(r[1])
+			proof, entries := tree.ProveRange(start, end)
+			var keys []string
+			for _, m := range entries {
+				keys = append(keys, string(m.key))
+			}
+			require.Equal(t, collectRange(tree.Range(start, end), false), keys, "%q", r)
+			require.Nil(t, VerifyRangeProof(root, start, end, entries, proof), "%q", r)
+
+			if len(entries) > 0 {
+				// dropping, altering or adding an entry is detected
+				dropped := append(slices.Clone(entries[:len(entries)/2]), entries[len(entries)/2+1:]...)
+				require.ErrorIs(t, VerifyRangeProof(root, start, end, dropped, proof), ErrProofInvalid, "%q", r)
+				altered := slices.Clone(entries)
+				altered[0] = NewMessage(altered[0].key, []byte("forged"))
+				require.ErrorIs(t, VerifyRangeProof(root, start, end, altered, proof), ErrProofInvalid, "%q", r)
+			}
+			added := append(slices.Clone(entries), NewMessage(append(slices.Clone(start), 0xff), nil))
+			slices.SortFunc(added, func(a, b *Message) int { return bytes.Compare(a.key, b.key) })
+			require.ErrorIs(t, VerifyRangeProof(root, start, end, added, proof), ErrProofInvalid, "%q", r)
+		}
+	}
+}
+
+func TestProveRangeHidesNothing(t *testing.T) {
+	tree := NewTree(generate1(300), withChunker(FanoutChunker(3)))
+	root := tree.Root().merkleHash
+	start, end := []byte("150"), []byte("160")
+	proof, entries := tree.ProveRange(start, end)
+	require.Len(t, entries, 11)
+
+	// a proof of a narrower range can't stand for the wider one
+	narrow, _ := tree.ProveRange([]byte("155"), end)
+	require.ErrorIs(t, VerifyRangeProof(root, start, end, entries[5:], narrow), ErrProofInvalid)
+
+	// without a left neighbour the range must start at the first entry
+	p := *proof
+	p.Left = nil
+	require.ErrorIs(t, VerifyRangeProof(root, start, end, entries[1:], &p), ErrProofInvalid)
+
+	p = *proof
+	p.Right = ProofEntry{Tail: true}
+	require.ErrorIs(t, VerifyRangeProof(root, start, end, entries, &p), ErrProofInvalid)
+
+	p = *proof
+	p.Right = ProofEntry{Key: []byte("155")}
+	require.ErrorIs(t, VerifyRangeProof(root, start, end, entries, &p), ErrProofInvalid)
+}
+
+func TestProveAbsence(t *testing.T) {
+	empty := NewTree(nil, nil)
+	proof, ok := empty.ProveAbsence([]byte("x"))
+	require.True(t, ok)
+	require.Nil(t, VerifyAbsence(empty.Root().merkleHash, []byte("x"), proof))
+
+	tree := NewTree(generate1(300), nil)
+	root := tree.Root().merkleHash
+	for _, key := range []string{"", "0", "10a", "150\x00", "99999", "\xff"} {
+		proof, ok := tree.ProveAbsence([]byte(key))
+		require.True(t, ok, "%q", key)
+		require.Nil(t, VerifyAbsence(root, []byte(key), proof), "%q", key)
+
+		data, err := json.Marshal(proof)
+		require.Nil(t, err)
+		var decoded RangeProof
+		require.Nil(t, json.Unmarshal(data, &decoded))
+		require.Nil(t, VerifyAbsence(root, []byte(key), &decoded), "%q", key)
+	}
+
+	_, ok = tree.ProveAbsence([]byte("150"))
+	require.False(t, ok)
+	// the proof for a neighbouring key doesn't show "150" missing
+	proof, _ = tree.ProveAbsence([]byte("150\x00"))
+	require.ErrorIs(t, VerifyAbsence(root, []byte("150"), proof), ErrProofInvalid)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Refs give names to root hashes or to commits, see History. Branches live
+// under heads/ and move with every update, tags live under tags/ and never
+// move once created, and HEAD is a single movable ref. Every update is a
+// compare-and-swap on the previous root, so two writers can't silently
+// overwrite each other.
+//
+//	refs := NewRefs(kv)
+//	err := refs.Update(BranchRef("main"), old, tree.Root().merkleHash)
+type Refs struct {
+	kv KV
+}
+
+func NewRefs(kv KV) *Refs { return &Refs{kv: kv} }
+
+// RefPrefix starts the KV keys that hold refs.
+const RefPrefix = "ref:"
+
+const HEAD = "HEAD"
+
+func BranchRef(name string) string { return "heads/" + name }
+func TagRef(name string) string    { return "tags/" + name }
+
+var (
+	ErrRefNotFound  = errors.New("ref not found")
+	ErrRefConflict  = errors.New("ref has moved")
+	ErrRefImmutable = errors.New("tags can't be moved")
+	ErrRefName      = errors.New("invalid ref name")
+)
+
+type Ref struct {
+	Name string `json:"name"`
+	Root Hash   `json:"root"`
+}
+
+func refKey(name string) []byte { return []byte(RefPrefix + name) }
+
+func isTag(name string) bool { return strings.HasPrefix(name, "tags/") }
+
+// checkRefName accepts HEAD, heads/<name> and tags/<name>. Names may contain
+// slashes but no empty parts, spaces or control characters.
+func checkRefName(name string) error {
+	if name == HEAD {
+		return nil
+	}
+	kind, rest, _ := strings.Cut(name, "/")
+	if kind != "heads" && kind != "tags" || rest == "" {
+		return fmt.Errorf("%w: %q", ErrRefName, name)
+	}
+	for _, part := range strings.Split(rest, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("%w: %q", ErrRefName, name)
+		}
+	}
+	if strings.ContainsFunc(rest, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) {
+		return fmt.Errorf("%w: %q", ErrRefName, name)
+	}
+	return nil
+}
+
+// Get returns the root hash of the ref with the full name.
+func (r *Refs) Get(name string) (Hash, error) {
+	if err := checkRefName(name); err != nil {
+		return Hash{}, err
+	}
+	value, found, err := r.kv.Get(refKey(name))
+	if err != nil {
+		return Hash{}, err
+	}
+	if !found {
+		return Hash{}, fmt.Errorf("%w: %s", ErrRefNotFound, name)
+	}
+	root, err := HashFromBytes(value)
+	if err != nil {
+		return Hash{}, fmt.Errorf("ref %s: %w", name, err)
+	}
+	return root, nil
+}
+
+// Resolve looks name up as a full ref name, then as a branch and then as a
+// tag, so "main" finds heads/main.
+func (r *Refs) Resolve(name string) (Ref, error) {
+	candidates := []string{name}
+	if name != HEAD && !strings.HasPrefix(name, "heads/") && !isTag(name) {
+		candidates = []string{BranchRef(name), TagRef(name)}
+	}
+	for _, candidate := range candidates {
+		root, err := r.Get(candidate)
+		if errors.Is(err, ErrRefNotFound) {
+			continue
+		}
+		return Ref{Name: candidate, Root: root}, err
+	}
+	return Ref{}, fmt.Errorf("%w: %s", ErrRefNotFound, name)
+}
+
+// Update moves ref name from old to root. A zero old creates the ref, which
+// must not exist yet. Tags can only be created. The tree or the commit root
+// names must already be stored.
+func (r *Refs) Update(name string, old Hash, root Hash) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	if isTag(name) && !old.IsZero() {
+		return fmt.Errorf("%w: %s", ErrRefImmutable, name)
+	}
+	_, found, err := r.kv.Get(EncodeKeyWithKids(root))
+	if err == nil && !found {
+		found, err = NewHistory(r.kv).IsCommit(root)
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("ref %s: root %s: %w", name, root, ErrNodeMissing)
+	}
+	return r.swap(name, old, root[:])
+}
+
+// Delete removes ref name while it still points at old.
+func (r *Refs) Delete(name string, old Hash) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	if old.IsZero() {
+		return fmt.Errorf("%w: %s", ErrRefNotFound, name)
+	}
+	return r.swap(name, old, nil)
+}
+
+func (r *Refs) swap(name string, old Hash, value []byte) error {
+	var expected []byte
+	if !old.IsZero() {
+		expected = old[:]
+	}
+	swapped, err := r.kv.CompareAndSwap(refKey(name), expected, value)
+	if err != nil {
+		return err
+	}
+	if swapped {
+		return nil
+	}
+	if isTag(name) && old.IsZero() {
+		return fmt.Errorf("%w: %s already exists", ErrRefImmutable, name)
+	}
+	return fmt.Errorf("%w: %s is no longer at %s", ErrRefConflict, name, old)
+}
+
+// List returns every ref ordered by name.
+func (r *Refs) List() ([]Ref, error) {
+	refs := []Ref{}
+	cursor := r.kv.Cursor()
+	for cursor.Goto([]byte(RefPrefix)); bytes.HasPrefix(cursor.Key(), []byte(RefPrefix)); cursor.Next() {
+		name := strings.TrimPrefix(string(cursor.Key()), RefPrefix)
+		root, err := HashFromBytes(cursor.Value())
+		if err != nil {
+			return nil, fmt.Errorf("ref %s: %w", name, err)
+		}
+		refs = append(refs, Ref{Name: name, Root: root})
+	}
+	return refs, nil
+}
+
+// SerializeRef writes the tree and moves ref name from old to its root, see
+// Refs.Update. The config is stored with the root, so that any ref pointing
+// at it can load the tree.
+func (t *Tree) SerializeRef(name string, old Hash, onto KV) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	root, err := t.writeRoot(onto)
+	if err != nil {
+		return err
+	}
+	return NewRefs(onto).Update(name, old, root)
+}
+
+// writeRoot writes the nodes of the tree along with its config keyed by the
+// root hash, and returns the root hash.
+func (t *Tree) writeRoot(onto KV) (Hash, error) {
+	if err := t.writeNodes(onto); err != nil {
+		return Hash{}, err
+	}
+	root := t.Root().merkleHash
+	return root, writeRootConfig(onto, root, t.config)
+}
+
+// writeRootConfig stores config keyed by the root hash of a tree.
+func writeRootConfig(onto KV, root Hash, config *TreeConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return onto.Set([]byte(rootConfigKey(root)), data)
+}
+
+// DeserializeRef loads the tree ref name points at, or the tree of the commit
+// it points at. Short names are resolved as by Refs.Resolve.
+func DeserializeRef(name string, kv KV) (*Tree, error) {
+	return deserializeRef(name, kv, false)
+}
+
+// DeserializeRefVerified is DeserializeRef that checks every node like
+// DeserializeWithKidsVerified.
+func DeserializeRefVerified(name string, kv KV) (*Tree, error) {
+	return deserializeRef(name, kv, true)
+}
+
+func deserializeRef(name string, kv KV, verify bool) (*Tree, error) {
+	ref, err := NewRefs(kv).Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := NewHistory(kv).treeOf(ref.Root)
+	if err != nil {
+		return nil, fmt.Errorf("ref %s: %w", ref.Name, err)
+	}
+	config, err := loadRootConfig(root, kv)
+	if err != nil {
+		return nil, err
+	}
+	return loadTree(kv, root, config, verify, IntegrityError{Ref: ref.Name})
+}
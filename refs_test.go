@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefs(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	refs := NewRefs(kv)
+	v1 := NewTree(generate1(50), nil)
+	v2 := v1.Clone()
+	v2.Put([]byte("new"), []byte("entry"))
+	branch := BranchRef("main")
+
+	require.Nil(t, v1.SerializeRef(branch, Hash{}, kv))
+	require.ErrorIs(t, v2.SerializeRef(branch, Hash{}, kv), ErrRefConflict)
+	require.Nil(t, v2.SerializeRef(branch, v1.Root().merkleHash, kv))
+	require.ErrorIs(t, refs.Update(branch, v1.Root().merkleHash, v1.Root().merkleHash), ErrRefConflict)
+
+	require.Nil(t, refs.Update(TagRef("v1"), Hash{}, v1.Root().merkleHash))
+	require.ErrorIs(t, refs.Update(TagRef("v1"), Hash{}, v2.Root().merkleHash), ErrRefImmutable)
+	require.ErrorIs(t, refs.Update(TagRef("v1"), v1.Root().merkleHash, v2.Root().merkleHash), ErrRefImmutable)
+	require.Nil(t, refs.Update(HEAD, Hash{}, v2.Root().merkleHash))
+
+	var missing Hash
+	missing[0] = 1
+	require.ErrorIs(t, refs.Update(BranchRef("dangling"), Hash{}, missing), ErrNodeMissing)
+	for _, bad := range []string{"main", "heads/", "heads//x", "heads/a b", "tags/..", "other/x", "HEAD/x"} {
+		require.ErrorIs(t, refs.Update(bad, Hash{}, v1.Root().merkleHash), ErrRefName, bad)
+	}
+
+	list, err := refs.List()
+	require.Nil(t, err)
+	require.Equal(t, []Ref{
+		{HEAD, v2.Root().merkleHash},
+		{branch, v2.Root().merkleHash},
+		{TagRef("v1"), v1.Root().merkleHash},
+	}, list)
+
+	for name, want := range map[string]*Tree{"main": v2, "v1": v1, branch: v2, HEAD: v2, TagRef("v1"): v1} {
+		loaded, err := DeserializeRefVerified(name, kv)
+		require.Nil(t, err, name)
+		require.Equal(t, want.Root().merkleHash, loaded.Root().merkleHash, name)
+	}
+	_, err = DeserializeRef("nope", kv)
+	require.ErrorIs(t, err, ErrRefNotFound)
+
+	require.ErrorIs(t, refs.Delete(TagRef("v1"), v2.Root().merkleHash), ErrRefConflict)
+	require.Nil(t, refs.Delete(TagRef("v1"), v1.Root().merkleHash))
+	_, err = refs.Get(TagRef("v1"))
+	require.ErrorIs(t, err, ErrRefNotFound)
+
+	// refs keep their trees alive through GC and are checked by fsck
+	report, err := GC(kv, nil, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, report.Refs)
+	require.Positive(t, report.Swept)
+	fsck, err := Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, fsck.OK(), "%v", fsck.Problems)
+	require.Empty(t, fsck.Orphans)
+	require.Len(t, fsck.Refs, 2)
+	_, err = DeserializeRefVerified("main", kv)
+	require.Nil(t, err)
+	_, found, err := kv.Get([]byte(rootConfigKey(v1.Root().merkleHash)))
+	require.Nil(t, err)
+	require.False(t, found)
+
+	// a broken tree is reported at its ref
+	leaf := v2.levels[0].tail.left
+	require.Nil(t, kv.Delete(leaf.KeyWithKids()))
+	_, err = DeserializeRef("main", kv)
+	var integrity *IntegrityError
+	require.ErrorAs(t, err, &integrity)
+	require.Equal(t, branch, integrity.Ref)
+	require.Contains(t, fsckKinds(t, kv), FsckMissingNode)
+}
+
+func TestRefsCompareAndSwap(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	tree := NewTree(generate1(10), nil)
+	require.Nil(t, tree.SerializeRef(HEAD, Hash{}, kv))
+	root := tree.Root().merkleHash
+
+	// every writer tries to create the same branch, only one may win
+	refs := NewRefs(kv)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if refs.Update(BranchRef("race"), Hash{}, root) == nil {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, won)
+
+	swapped, err := kv.CompareAndSwap([]byte("k"), nil, []byte("1"))
+	require.Nil(t, err)
+	require.True(t, swapped)
+	swapped, err = kv.CompareAndSwap([]byte("k"), []byte("2"), []byte("3"))
+	require.Nil(t, err)
+	require.False(t, swapped)
+	swapped, err = kv.CompareAndSwap([]byte("k"), []byte("1"), nil)
+	require.Nil(t, err)
+	require.True(t, swapped)
+	_, found, err := kv.Get([]byte("k"))
+	require.Nil(t, err)
+	require.False(t, found)
+}
+
+func TestRefCommands(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewKVFileAt(dir)
+	v1, v2 := NewTree(generate1(20), nil), NewTree(generate1(30), nil)
+	require.Nil(t, v1.SerializeWithKids(1, kv))
+	require.Nil(t, v2.SerializeWithKids(2, kv))
+	root1, root2 := v1.Root().merkleHash.String(), v2.Root().merkleHash.String()
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, run([]string{"ref", "-dir", dir, "-name", "heads/main", "-gen", "1"}, &stdout, &stderr), stderr.String())
+	require.Equal(t, 0, run([]string{"ref", "-dir", dir, "-name", "tags/v1", "-to", root1}, &stdout, &stderr), stderr.String())
+	require.Equal(t, 2, run([]string{"ref", "-dir", dir, "-name", "heads/main", "-gen", "2"}, &stdout, &stderr))
+	require.Equal(t, 0, run([]string{"ref", "-dir", dir, "-name", "heads/main", "-gen", "2", "-old", root1}, &stdout, &stderr), stderr.String())
+	require.Equal(t, 2, run([]string{"ref", "-dir", dir, "-name", "tags/v1", "-to", root2, "-old", root1}, &stdout, &stderr))
+	require.Equal(t, 2, run([]string{"ref", "-dir", dir, "-name", "heads/x", "-gen", "1", "-to", root1}, &stdout, &stderr))
+
+	stdout.Reset()
+	require.Equal(t, 0, run([]string{"ref", "-dir", dir, "-name", "main"}, &stdout, &stderr), stderr.String())
+	var ref Ref
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &ref))
+	require.Equal(t, Ref{BranchRef("main"), v2.Root().merkleHash}, ref)
+
+	require.Equal(t, 0, run([]string{"ref", "-dir", dir, "-name", "tags/v1", "-delete", "-old", root1}, &stdout, &stderr), stderr.String())
+	stdout.Reset()
+	require.Equal(t, 0, run([]string{"refs", "-dir", dir}, &stdout, &stderr), stderr.String())
+	var refs []Ref
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &refs))
+	require.Equal(t, []Ref{ref}, refs)
+	require.Equal(t, 2, run([]string{"ref", "-dir", dir, "-name", "v1"}, &stdout, &stderr))
+}
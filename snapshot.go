@@ -0,0 +1,218 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot is a read-only version of a tree that any number of goroutines may
+// read at once. A Tree may be read concurrently too, but only while nobody
+// edits it. A snapshot is made of stored nodes held in memory, which are
+// never modified, so the versions published by Current share every subtree
+// an update left alone. To change a snapshot, Edit a copy and take a new
+// snapshot of that, or go through Current.Update.
+type Snapshot struct {
+	tree   *LazyTree // every node is in memory
+	config *TreeConfig
+	len    int
+}
+
+// Snapshot returns a snapshot of the current state of t. t may be edited
+// afterwards without affecting the snapshot. It copies every node, which
+// takes time and memory linear in the size of the tree.
+func (t *Tree) Snapshot() *Snapshot { return newSnapshotBuilder(nil).snapshot(t) }
+
+// Edit returns a mutable copy of the snapshot. It rebuilds the tree from its
+// entries, which takes time linear in its size.
+func (s *Snapshot) Edit() *Tree {
+	var messages []*Message
+	it := s.Range(nil, nil)
+	for ok := it.First(); ok; ok = it.Next() {
+		messages = append(messages, NewMessage(it.Key(), it.Value()))
+	}
+	return NewTree(messages, s.config)
+}
+
+func (s *Snapshot) Config() *TreeConfig { return s.config }
+func (s *Snapshot) RootHash() Hash      { return s.tree.root }
+func (s *Snapshot) Height() int         { return int(s.tree.top.level) + 1 }
+func (s *Snapshot) Len() int            { return s.len }
+
+// Get is Tree.Get. The value belongs to the snapshot and must not be
+// modified.
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	value, found, err := s.tree.Get(key)
+	mustNil(err)
+	return value, found
+}
+
+// Range is Tree.Range. Each goroutine needs its own iterator. Its Err is
+// always nil, as the nodes are in memory.
+func (s *Snapshot) Range(start []byte, end []byte) *LazyRangeIter { return s.tree.Range(start, end) }
+
+func (s *Snapshot) Prove(key []byte) (*Proof, bool) {
+	proof, found, err := s.tree.prove(s.config.Hasher, key)
+	mustNil(err)
+	return proof, found
+}
+
+func (s *Snapshot) ProveRange(start []byte, end []byte) (*RangeProof, []*Message) {
+	proof, entries, err := s.tree.proveRange(s.config.Hasher, start, end)
+	mustNil(err)
+	return proof, entries
+}
+
+func (s *Snapshot) ProveAbsence(key []byte) (*RangeProof, bool) {
+	proof, absent, err := s.tree.proveAbsence(s.config.Hasher, key)
+	mustNil(err)
+	return proof, absent
+}
+
+// Diff returns the changes that turn s into target. Subtrees the two
+// snapshots share are skipped.
+func (s *Snapshot) Diff(target *Snapshot) DeltaTrio {
+	must(s.config.Equal(target.config), "trees must share a config")
+	out, err := DiffLazy(s.tree, target.tree)
+	mustNil(err)
+	return out
+}
+
+// SerializeRef is Tree.SerializeRef.
+func (s *Snapshot) SerializeRef(name string, old Hash, onto KV) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	if err := recordHasher(onto, s.config.Hasher); err != nil {
+		return err
+	}
+	if err := s.tree.top.write(onto); err != nil {
+		return err
+	}
+	if err := writeRootConfig(onto, s.tree.root, s.config); err != nil {
+		return err
+	}
+	return NewRefs(onto).Update(name, old, s.tree.root)
+}
+
+// write stores n and the nodes below it, kids first.
+func (n *StoredNode) write(onto KV) error {
+	for _, kid := range n.loaded {
+		if err := kid.write(onto); err != nil {
+			return err
+		}
+	}
+	kids := slices.Clone(n.kids)
+	slices.Reverse(kids)
+	return onto.Set(EncodeKeyWithKids(n.hash), EncodeValueWithKids(n.level, n.tail, kids, n.key, n.value))
+}
+
+// nodes adds n and the nodes below it to into.
+func (n *StoredNode) nodes(into map[Hash]*StoredNode) {
+	into[n.hash] = n
+	for _, kid := range n.loaded {
+		kid.nodes(into)
+	}
+}
+
+// snapshotBuilder turns the nodes of a Tree into stored nodes. Nodes whose
+// hash matches a node of the previous version are reused along with their
+// whole subtree, so only the paths an edit touched are copied.
+type snapshotBuilder struct {
+	previous map[Hash]*StoredNode // the nodes of the previous version
+	kept     map[Hash]bool        // the previous nodes that were reused
+	fresh    []*StoredNode
+}
+
+func newSnapshotBuilder(previous map[Hash]*StoredNode) *snapshotBuilder {
+	return &snapshotBuilder{previous: previous, kept: map[Hash]bool{}}
+}
+
+func (b *snapshotBuilder) snapshot(t *Tree) *Snapshot {
+	root := b.build(t.Root())
+	return &Snapshot{tree: &LazyTree{root: root.hash, top: root}, config: t.config, len: t.Len()}
+}
+
+func (b *snapshotBuilder) build(n *Node) *StoredNode {
+	if s, ok := b.previous[n.merkleHash]; ok {
+		b.kept[n.merkleHash] = true
+		return s
+	}
+	s := &StoredNode{hash: n.merkleHash, level: n.level, tail: n.isTail, key: n.key, value: n.value}
+	n.Kids(func(kid *Node) { s.loaded = append(s.loaded, b.build(kid)) })
+	slices.Reverse(s.loaded)
+	for _, kid := range s.loaded {
+		s.kids = append(s.kids, kid.hash)
+	}
+	b.fresh = append(b.fresh, s)
+	return s
+}
+
+// update turns previous into the nodes of the version just built: the nodes
+// below old that were not reused are dropped and the fresh ones are added.
+func (b *snapshotBuilder) update(old *StoredNode) {
+	b.drop(old)
+	for _, n := range b.fresh {
+		b.previous[n.hash] = n
+	}
+}
+
+func (b *snapshotBuilder) drop(n *StoredNode) {
+	if b.kept[n.hash] {
+		return
+	}
+	delete(b.previous, n.hash)
+	for _, kid := range n.loaded {
+		b.drop(kid)
+	}
+}
+
+// Current holds the latest snapshot of a dataset. Readers Load it without
+// blocking and keep reading the snapshot they got for as long as they like,
+// while a writer prepares the next version with Update.
+//
+//	current := NewCurrent(tree.Snapshot())
+//	value, found := current.Load().Get(key)
+type Current struct {
+	snapshot atomic.Pointer[Snapshot]
+	mu       sync.Mutex // serializes Update and guards the fields below
+
+	// The writer keeps the latest version as a Tree to edit, and the nodes of
+	// the latest snapshot to reuse. Both are nil until the first Update.
+	tree  *Tree
+	nodes map[Hash]*StoredNode
+}
+
+func NewCurrent(s *Snapshot) *Current {
+	c := &Current{}
+	c.snapshot.Store(s)
+	return c
+}
+
+func (c *Current) Load() *Snapshot { return c.snapshot.Load() }
+
+// Update applies edit to the latest version and publishes the result.
+// Updates run one at a time. The tree passed to edit belongs to Current and
+// must not be used once edit returns. The new snapshot shares every node the
+// edit didn't touch with the latest one, so publishing costs in proportion
+// to the edited paths rather than to the size of the tree. The first Update,
+// and the first one after a failed edit, rebuild the tree with Edit. When
+// edit fails, the latest snapshot is kept and the error returned.
+func (c *Current) Update(edit func(*Tree) error) (*Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	latest := c.Load()
+	if c.tree == nil {
+		c.tree, c.nodes = latest.Edit(), map[Hash]*StoredNode{}
+		latest.tree.top.nodes(c.nodes)
+	}
+	if err := edit(c.tree); err != nil {
+		c.tree, c.nodes = nil, nil // the tree may be half edited
+		return nil, err
+	}
+	b := newSnapshotBuilder(c.nodes)
+	next := b.snapshot(c.tree)
+	b.update(latest.tree.top)
+	c.snapshot.Store(next)
+	return next, nil
+}
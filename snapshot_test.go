@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	tree := NewTree(generate1(50), nil)
+	snapshot := tree.Snapshot()
+	root := snapshot.RootHash()
+	tree.Put([]byte("new"), []byte("entry"))
+	require.Equal(t, root, snapshot.RootHash())
+	_, found := snapshot.Get([]byte("new"))
+	require.False(t, found)
+	require.Equal(t, 50, snapshot.Len())
+
+	edited := snapshot.Edit()
+	require.Equal(t, root, edited.Root().merkleHash)
+	require.NotContains(t, boundaries(edited), "?")
+	edited.Put([]byte("new"), []byte("entry"))
+	require.Equal(t, tree.Root().merkleHash, edited.Root().merkleHash)
+	require.Equal(t, tree.Height(), edited.Snapshot().Height())
+	require.Equal(t, Diff(NewTree(generate1(50), nil), tree), snapshot.Diff(edited.Snapshot()))
+
+	kv := NewKVFile()
+	kv.MustReset()
+	require.Nil(t, snapshot.SerializeRef(HEAD, Hash{}, kv))
+	loaded, err := DeserializeRefVerified(HEAD, kv)
+	require.Nil(t, err)
+	require.Equal(t, root, loaded.Root().merkleHash)
+	fsck, err := Fsck(kv)
+	require.Nil(t, err)
+	require.True(t, fsck.OK(), "%v", fsck.Problems)
+
+	current := NewCurrent(snapshot)
+	failure := errors.New("nope")
+	_, err = current.Update(func(t *Tree) error {
+		t.Put([]byte("lost"), nil)
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, snapshot, current.Load())
+	next, err := current.Update(func(t *Tree) error { return nil })
+	require.Nil(t, err)
+	require.Equal(t, root, next.RootHash())
+}
+
+func TestSnapshotProofs(t *testing.T) {
+	tree := NewTree(generateSorted(1000), nil)
+	snapshot := tree.Snapshot()
+	root := snapshot.RootHash()
+	for _, key := range []string{"0000", "0500", "0999"} {
+		proof, found := snapshot.Prove([]byte(key))
+		require.True(t, found)
+		want, _ := tree.Prove([]byte(key))
+		require.Equal(t, want, proof)
+		value, _ := snapshot.Get([]byte(key))
+		require.Nil(t, VerifyProof(root, []byte(key), value, proof))
+	}
+	_, found := snapshot.Prove([]byte("05000"))
+	require.False(t, found)
+
+	for _, c := range [][2]string{{"", ""}, {"0100", "0200"}, {"00995", "0500"}, {"0990", ""}, {"2000", ""}, {"", "0000"}} {
+		start, end := []byte(c[0]), []byte(c[1])
+		proof, entries := snapshot.ProveRange(start, end)
+		wantProof, wantEntries := tree.ProveRange(start, end)
+		require.Equal(t, wantProof, proof, c)
+		require.Equal(t, wantEntries, entries, c)
+		require.Nil(t, VerifyRangeProof(root, start, end, entries, proof), c)
+	}
+	proof, absent := snapshot.ProveAbsence([]byte("05000"))
+	require.True(t, absent)
+	require.Nil(t, VerifyAbsence(root, []byte("05000"), proof))
+	_, absent = snapshot.ProveAbsence([]byte("0500"))
+	require.False(t, absent)
+
+	empty := NewTree(nil, nil).Snapshot()
+	proof, entries := empty.ProveRange(nil, nil)
+	require.Empty(t, entries)
+	require.Nil(t, VerifyRangeProof(empty.RootHash(), nil, nil, nil, proof))
+}
+
+// storedNodes returns the nodes of s by hash.
+func storedNodes(s *Snapshot) map[Hash]*StoredNode {
+	nodes := map[Hash]*StoredNode{}
+	s.tree.top.nodes(nodes)
+	return nodes
+}
+
+func TestSnapshotSharing(t *testing.T) {
+	current := NewCurrent(NewTree(generateSorted(1000), nil).Snapshot())
+	v1 := current.Load()
+	v2, err := current.Update(func(t *Tree) error {
+		t.Put([]byte("0999"), []byte("changed"))
+		return nil
+	})
+	require.Nil(t, err)
+	require.NotEqual(t, v1.RootHash(), v2.RootHash())
+
+	// the subtree left of the edit is the very same in both versions
+	require.Greater(t, len(v1.tree.top.loaded), 1)
+	require.Same(t, v1.tree.top.loaded[0], v2.tree.top.loaded[0])
+	nodes1, nodes2 := storedNodes(v1), storedNodes(v2)
+	fresh := 0
+	for hash, n := range nodes2 {
+		if nodes1[hash] != n {
+			fresh++
+		}
+	}
+	require.Positive(t, fresh)
+	require.Less(t, fresh, 4*v2.Height())
+	value, _ := v1.Get([]byte("0999"))
+	require.Equal(t, []byte("value 999"), value)
+
+	// every later version shares all but its edited paths with the previous
+	// one, and the writer holds no stale nodes
+	for i := range 20 {
+		previous := storedNodes(current.Load())
+		next, err := current.Update(func(t *Tree) error {
+			t.Put([]byte(fmt.Sprintf("%04d", i*37)), []byte("again"))
+			t.Delete([]byte(fmt.Sprintf("%04d", 500+i)))
+			return nil
+		})
+		require.Nil(t, err)
+		fresh := 0
+		for hash, n := range storedNodes(next) {
+			if previous[hash] != n {
+				fresh++
+			}
+		}
+		require.Less(t, fresh, 8*next.Height(), i)
+	}
+	latest := current.Load()
+	require.Equal(t, storedNodes(latest), current.nodes)
+	rebuilt := latest.Edit()
+	require.Equal(t, rebuilt.Root().merkleHash, latest.RootHash())
+	require.Equal(t, rebuilt.Len(), latest.Len())
+}
+
+// readSnapshot reads every entry of s, which holds the keys 1 to its size.
+func readSnapshot(s *Snapshot) error {
+	key := []byte(strconv.Itoa(s.Len()))
+	value, _ := s.Get(key)
+	proof, _ := s.Prove(key)
+	if err := VerifyProof(s.RootHash(), key, value, proof); err != nil {
+		return err
+	}
+	for i := 1; i <= s.Len(); i++ {
+		if _, found := s.Get([]byte(strconv.Itoa(i))); !found {
+			return fmt.Errorf("key %d not found", i)
+		}
+	}
+	if n := len(collectLazyRange(s.Range(nil, nil), false)); n != s.Len() {
+		return fmt.Errorf("range has %d entries, want %d", n, s.Len())
+	}
+	return nil
+}
+
+// readTree is readSnapshot for a tree.
+func readTree(tree *Tree) error {
+	key := []byte(strconv.Itoa(tree.Len()))
+	value, _ := tree.Get(key)
+	proof, _ := tree.Prove(key)
+	if err := VerifyProof(tree.Root().merkleHash, key, value, proof); err != nil {
+		return err
+	}
+	for i := 1; i <= tree.Len(); i++ {
+		if _, found := tree.Get([]byte(strconv.Itoa(i))); !found {
+			return fmt.Errorf("key %d not found", i)
+		}
+	}
+	if n := len(collectRange(tree.Range(nil, nil), false)); n != tree.Len() {
+		return fmt.Errorf("range has %d entries, want %d", n, tree.Len())
+	}
+	return nil
+}
+
+// TestSnapshotConcurrent is meant for go test -race: readers share an edited
+// tree, then keep reading the snapshots a writer publishes. The readers don't
+// use t, whose locking would hide races between them.
+func TestSnapshotConcurrent(t *testing.T) {
+	tree := NewTree(generate1(99), nil)
+	tree.Put([]byte("100"), []byte("v"))
+	current := NewCurrent(tree.Snapshot())
+	var readers, started sync.WaitGroup
+	writing := make(chan struct{})
+	failures := make([]error, 4)
+	for reader := range failures {
+		readers.Add(1)
+		started.Add(1)
+		go func() {
+			defer readers.Done()
+			failures[reader] = readTree(tree)
+			started.Done()
+			<-writing
+			for range 10 {
+				if err := readSnapshot(current.Load()); err != nil && failures[reader] == nil {
+					failures[reader] = err
+				}
+			}
+		}()
+	}
+	started.Wait()
+	close(writing)
+	for i := 101; i <= 120; i++ {
+		_, err := current.Update(func(t *Tree) error {
+			t.Put([]byte(strconv.Itoa(i)), []byte("v"))
+			return nil
+		})
+		require.Nil(t, err)
+		runtime.Gosched()
+	}
+	readers.Wait()
+	require.Nil(t, errors.Join(failures...))
+	require.Equal(t, 120, current.Load().Len())
+}
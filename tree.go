@@ -1,9 +1,10 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"encoding/binary"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,30 +12,44 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Message struct {
-	timestamp string
-	data      string
+	key   []byte
+	value []byte
 }
 
-func NewMessage(timestamp string, data string) *Message {
-	return &Message{timestamp: timestamp, data: data}
+func NewMessage(key []byte, value []byte) *Message {
+	return &Message{key: key, value: value}
 }
 
+// Tree is an in-memory prolly tree. Building or editing a tree decides the
+// boundary of every node, so reads don't write: any number of goroutines may
+// read a tree as long as none edits it.
 type Tree struct {
 	// kv KV
 	// cursor
 	// encoder
 	levels []*Level
+	config *TreeConfig
 }
 
 func (t *Tree) Height() int { return len(t.levels) }
 func (t *Tree) Root() *Node { return t.levels[len(t.levels)-1].tail }
 
-func NewTree(messages []*Message) *Tree {
-	tree := &Tree{}
-	base := BaseLevel(messages)
+// Len returns the number of entries, the tail not included.
+func (t *Tree) Len() int { return t.levels[0].size - 1 }
+
+// NewTree builds a tree from messages. A nil config means
+// DefaultTreeConfig. Trees are only comparable with Diff when their configs
+// are equal.
+func NewTree(messages []*Message, config *TreeConfig) *Tree {
+	if config == nil {
+		config = DefaultTreeConfig()
+	}
+	tree := &Tree{config: config}
+	base := BaseLevel(messages, config)
 	tree.levels = append(tree.levels, base)
 	for !base.OnlyTail() {
 		base = NextLevel(base)
@@ -43,6 +58,32 @@ func NewTree(messages []*Message) *Tree {
 	return tree
 }
 
+func (t *Tree) Config() *TreeConfig { return t.config }
+
+// Get returns the value stored under key. The lookup descends from the root
+// and inspects a single bucket per level. The value belongs to the tree and
+// must not be modified.
+func (t *Tree) Get(key []byte) ([]byte, bool) {
+	n := t.seek(key)
+	if n.compareTo(key) != 0 {
+		return nil, false
+	}
+	return n.value, true
+}
+
+// seek descends from the root and returns the first level0 node whose key is
+// greater than or equal to key. When every key is less, the tail is returned.
+func (t *Tree) seek(key []byte) *Node {
+	p := t.Root()
+	for p.down != nil {
+		p = p.down
+		for p.left != nil && !p.left.IsBoundary() && p.left.compareTo(key) >= 0 {
+			p = p.left
+		}
+	}
+	return p
+}
+
 func (t *Tree) Dot(filename string) {
 	// Run: dot -Kneato -Tpng -o tree.png tree.dot
 	f, err := os.Create(filename)
@@ -126,14 +167,11 @@ func (t *Tree) Dot(filename string) {
 		}
 
 		// Truncate merkleHash for cleaner display
-		shortHash := node.merkleHash
-		if len(shortHash) > 4 {
-			shortHash = shortHash[:4]
-		}
+		shortHash := node.merkleHash.String()[:4]
 
 		// Create node label with all relevant information
-		label := fmt.Sprintf("ts: %s\\nhash: %s\\ntype: %s\\nlevel: %d",
-			node.timestamp, shortHash, nodeType, node.level)
+		label := fmt.Sprintf("key: %s\\nhash: %s\\ntype: %s\\nlevel: %d",
+			node.key, shortHash, nodeType, node.level)
 
 		// Style nodes based on type
 		fillcolor := "white"
@@ -190,6 +228,42 @@ func (t *Tree) Dot(filename string) {
 	fmt.Fprintln(f, "}")
 }
 
+// Clone returns a deep copy of the tree that shares no nodes with t. The
+// boundary decisions are copied along, so the clone is ready to be read.
+func (t *Tree) Clone() *Tree {
+	copies := map[*Node]*Node{}
+	clone := &Tree{config: t.config}
+	for _, level := range t.levels {
+		next := &Level{level: level.level, size: level.size}
+		var right *Node
+		for n := level.tail; n != nil; n = n.left {
+			c := &Node{
+				level:      n.level,
+				key:        n.key,
+				value:      n.value,
+				merkleHash: n.merkleHash,
+				boundary:   n.boundary,
+				isTail:     n.isTail,
+				config:     n.config,
+				right:      right,
+			}
+			if right != nil {
+				right.left = c
+			} else {
+				next.tail = c
+			}
+			if n.down != nil {
+				c.down = copies[n.down]
+				c.down.up = c
+			}
+			copies[n] = c
+			right = c
+		}
+		clone.levels = append(clone.levels, next)
+	}
+	return clone
+}
+
 func (t *Tree) String() string {
 	var sb strings.Builder
 	for _, level := range t.levels {
@@ -225,7 +299,10 @@ func (l *Level) AsList() []*Node {
 func (l *Level) String() string {
 	xs := []string{"tail"}
 	for t := l.tail; t != nil; t = t.left {
-		s := fmt.Sprintf("%s", t.timestamp)
+		s := string(t.key)
+		if t.isTail {
+			s = "<TAIL>"
+		}
 		if t.IsBoundary() {
 			s += "*"
 		}
@@ -237,18 +314,18 @@ func (l *Level) String() string {
 	return fmt.Sprintf("Level(level=%d, size=%d, %s)", l.level, l.size, ts)
 }
 
-func BaseLevel(messages []*Message) *Level {
+func BaseLevel(messages []*Message, config *TreeConfig) *Level {
 	level := NewLevel(0)
 	var nodes []*Node
 	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].timestamp < messages[j].timestamp
+		return bytes.Compare(messages[i].key, messages[j].key) < 0
 	})
 	const notTail = false
 	for _, m := range messages {
-		nodes = append(nodes, NewNode(m.timestamp, m.data, notTail))
+		nodes = append(nodes, NewNode(m.key, m.value, notTail, config))
 	}
 	const isTail = true
-	nodes = append(nodes, NewNode(TailKey(), "tail", isTail))
+	nodes = append(nodes, NewNode(nil, nil, isTail, config))
 	level.tail = LinkNodes(nodes)[len(nodes)-1]
 	level.size = len(nodes)
 	return level
@@ -282,20 +359,20 @@ func LinkNodes(nodes []*Node) []*Node {
 
 // ----------------------------------------------------------------
 
-// const HashSize = 32
-const HashSize = 64
+const HashSize = 32
 
 type Node struct {
 	level      int8
-	timestamp  string // key
-	data       string // value
+	key        []byte
+	value      []byte
 	up         *Node
 	down       *Node
 	left       *Node
 	right      *Node
-	merkleHash string // rolling merkle hash
+	merkleHash Hash // rolling merkle hash
 	boundary   *bool
 	isTail     bool
+	config     *TreeConfig
 }
 
 func (n *Node) Iter() Iter { return &NodeIter{P: n} }
@@ -308,45 +385,45 @@ func (n *Node) Iter() Iter { return &NodeIter{P: n} }
 //   in this design, it's on the right side.
 //
 
-func TailKey() string           { return "<TAIL>" }
-func IsTailKey(key string) bool { return key == TailKey() }
-
-func NewNode(timestamp string, data string, isTail bool) *Node {
-	payload := timestamp + data
-	hash := Rehash(payload)
+func NewNode(key []byte, value []byte, isTail bool, config *TreeConfig) *Node {
+	hash := LeafHash(config.Hasher, isTail, key, value)
 	node := &Node{
-		timestamp:  timestamp,
-		data:       data,
+		key:        key,
+		value:      value,
 		isTail:     isTail,
 		merkleHash: hash,
 		boundary:   nil,
+		config:     config,
 	}
 	return node
 }
 
-func (n *Node) Key() string {
-	return StrEncodeKey(n.level, fmt.Sprintf("%s", n.timestamp))
+func (n *Node) EncodedKey() []byte {
+	return EncodeKey(n.level, n.key)
 }
 
-func (n *Node) Value() string {
-	return StrEncodeValue(n.merkleHash, n.data)
+func (n *Node) EncodedValue() []byte {
+	return EncodeValue(n.merkleHash, n.value)
 }
 
-func (n *Node) KeyWithKids() string {
-	// hash
-	return StrEncodeKeyWithKids(n.merkleHash)
+func (n *Node) KeyWithKids() []byte {
+	return EncodeKeyWithKids(n.merkleHash)
 }
 
-func (n *Node) ValueWithKids() string {
-	kids := []string{}
-	n.Kids(func(n *Node) {
-		kids = append(kids, n.merkleHash)
-	})
-	return StrEncodeValueWithKids(n.level, kids, n.timestamp, n.data)
+func (n *Node) ValueWithKids() []byte {
+	return EncodeValueWithKids(n.level, n.isTail, n.ListKids(), n.key, n.value)
 }
 
 func (n *Node) String() string {
-	return fmt.Sprintf("Node(timestamp=%q, level=%d)", n.timestamp, n.level)
+	return fmt.Sprintf("Node(key=%q, level=%d)", n.key, n.level)
+}
+
+// compareTo compares the key of n with key, the tail being the largest key.
+func (n *Node) compareTo(key []byte) int {
+	if n.isTail {
+		return 1
+	}
+	return bytes.Compare(n.key, key)
 }
 
 // -1 when left is less, 0 when equal, 1 when right is less
@@ -359,13 +436,7 @@ func (n *Node) CompareKey(o *Node) int {
 	case "false_true":
 		return -1
 	case "false_false":
-		if n.timestamp < o.timestamp {
-			return -1
-		}
-		if n.timestamp > o.timestamp {
-			return 1
-		}
-		return 0
+		return bytes.Compare(n.key, o.key)
 	default:
 		panic("unreachable")
 	}
@@ -391,7 +462,7 @@ func (n *Node) Kids(cb func(*Node)) {
 	n.down.UntilBoundary(cb)
 }
 
-func (n *Node) ListKids() (out []string) {
+func (n *Node) ListKids() (out []Hash) {
 	n.Kids(func(p *Node) {
 		out = append(out, p.merkleHash)
 	})
@@ -409,20 +480,49 @@ func (n *Node) UntilBoundary(cb func(*Node)) {
 }
 
 func (n *Node) IsBoundary() bool {
+	if n.isTail {
+		return true
+	}
 	if n.boundary != nil {
 		return *n.boundary
 	}
-	boundary := n.isTail || IsBoundaryHash(n.merkleHash)
-	n.boundary = &boundary
-	return boundary
+	// The chunker may look at the size of the chunk so far, which depends on
+	// the decisions made on the left. Decide the undecided nodes left to right.
+	pending := []*Node{n}
+	for p := n.left; p != nil && p.boundary == nil; p = p.left {
+		pending = append(pending, p)
+	}
+	var chunk ChunkStats
+	for p := pending[len(pending)-1].left; p != nil && !*p.boundary; p = p.left {
+		chunk.Entries++
+		chunk.Bytes += p.EncodedSize()
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		p := pending[i]
+		chunk.Entries++
+		chunk.Bytes += p.EncodedSize()
+		boundary := p.config.Chunker.IsBoundary(p.merkleHash, chunk)
+		p.boundary = &boundary
+		if boundary {
+			chunk = ChunkStats{}
+		}
+	}
+	return *n.boundary
+}
+
+// EncodedSize is the size of the node as written by SerializeWithKids.
+func (n *Node) EncodedSize() int {
+	kids := 0
+	n.Kids(func(*Node) { kids++ })
+	return EncodedSizeWithKids(kids, n.key, n.value)
 }
 
 func (n *Node) CreateHigherLevel() *Node {
-	node := NewNode(n.timestamp, "", n.isTail)
+	node := NewNode(n.key, nil, n.isTail, n.config)
 	node.level = n.level + 1
 	node.down = n
 	n.up = node
-	node.merkleHash = "" // to be filled later by FillMerkleHash
+	node.merkleHash = Hash{} // to be filled later by FillMerkleHash
 	return node
 }
 
@@ -444,47 +544,74 @@ func (n *Node) FillMerkleHash() {
 	}
 
 	for _, node := range bucket {
-		if node.merkleHash == "" {
+		if node.merkleHash.IsZero() {
 			node.FillMerkleHash()
 		}
 	}
 
 	slices.Reverse(bucket)
-	n.merkleHash = BucketHash(bucket)
+	n.merkleHash = BucketHash(n.config.Hasher, n.level, bucket)
 }
 
 const AverageBucketSize = 10
 const BoundaryThreshold = uint32((1 << 32) / AverageBucketSize)
 
-func IsBoundaryHash(hash string) bool {
-	hashBytes, _ := hex.DecodeString(hash)
-	value := binary.BigEndian.Uint32(hashBytes[:4])
-	return value < BoundaryThreshold
+func IsBoundaryHash(hash Hash) bool {
+	return HashPrefix(hash) < BoundaryThreshold
+}
+
+// HashPrefix reads the first 4 bytes of a hash as a big endian number.
+func HashPrefix(hash Hash) uint32 {
+	return binary.BigEndian.Uint32(hash[:4])
 }
 
 const BoundaryThresholdBits = 5
 
-func IsBoundaryHash2(hash string) bool {
-	digit := hash[:1]
-	must(len(digit) == 1, "hash must be a single digit")
-	hashInt, _ := strconv.ParseInt(digit, 16, 64)
-	return hashInt < BoundaryThresholdBits
+func IsBoundaryHash2(hash Hash) bool {
+	return hash[0]>>4 < BoundaryThresholdBits
 }
 
-func Rehash(xs ...string) string {
-	h := sha256.New()
-	for _, x := range xs {
-		h.Write([]byte(x))
+// LeafHash returns the hash of a level0 node. The key is prefixed with its
+// length, so that moving bytes between the key and the value changes the
+// hash, and the tail is told apart from an entry with an empty key.
+func LeafHash(hasher Hasher, isTail bool, key []byte, value []byte) (h Hash) {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(key)+len(value))
+	if isTail {
+		buf = append(buf, tailFlag)
+	} else {
+		buf = append(buf, notTailFlag)
 	}
-	return hex.EncodeToString(h.Sum(nil))
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	copy(h[:], hasher.Sum(buf))
+	return h
 }
 
-func BucketHash(nodes []*Node) string {
-	var sb strings.Builder
-	for _, node := range nodes {
-		sb.WriteString(node.merkleHash)
+// BucketHash returns the hash of the node at level whose kids are nodes, in
+// ascending order.
+func BucketHash(hasher Hasher, level int8, nodes []*Node) Hash {
+	hashes := make([]Hash, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = node.merkleHash
+	}
+	return bucketHashOf(hasher, level, hashes)
+}
+
+// bucketFlag starts what a bucket hash is computed over, where LeafHash has
+// tailFlag or notTailFlag, so that no node can pass for a leaf or the other
+// way round. The level follows, so that a node can't pass for one of another
+// level either.
+const bucketFlag = 'B'
+
+func bucketHashOf(hasher Hasher, level int8, hashes []Hash) (h Hash) {
+	buf := make([]byte, 0, 2+len(hashes)*HashSize)
+	buf = append(buf, bucketFlag, byte(level))
+	for _, hash := range hashes {
+		buf = append(buf, hash[:]...)
 	}
-	return Rehash(sb.String())
+	copy(h[:], hasher.Sum(buf))
+	return h
 }
 
 func must(cond bool, msg string) {
@@ -522,16 +649,19 @@ func must(cond bool, msg string) {
 // }
 
 type Delta struct {
-	key    string // timestamp
+	key    []byte
 	typ    string // "add", "remove", "update"
-	source string
-	target string
+	source []byte // nil for "add"
+	target []byte // nil for "remove"
 }
 
 type DeltaTrio struct {
 	Add    []Delta
 	Remove []Delta
 	Update []Delta
+
+	SourceRoot Hash // merkle hash of the tree the deltas apply to
+	TargetRoot Hash // merkle hash of the tree the deltas produce
 }
 
 type Iter interface {
@@ -622,21 +752,25 @@ func (c *Chain) Left() *Node {
 }
 
 func Diff(source, target *Tree) (out DeltaTrio) {
+	must(source.config.Equal(target.config), "trees must share a config")
 	minHeight := min(source.Root().level, target.Root().level)
 	s, t := source.Root().Descend(minHeight), target.Root().Descend(minHeight)
 	must(s.level == t.level, "levels must match")
 
 	var add, update []Delta
+	removing := false // the reverse run reports additions of the source as removals
 	emitUpdate := func(p1, p2 *Node) {
 		if update != nil {
-			fmt.Printf("= %v => %v\n", p1.timestamp, p2.timestamp)
-			update = append(update, Delta{key: p2.timestamp, typ: "update", source: p1.data, target: p2.data})
+			update = append(update, Delta{key: p2.key, typ: "update", source: p1.value, target: p2.value})
 		}
 	}
 	emitAdd := func(p2 *Node) {
 		if add != nil {
-			fmt.Printf("+ p2 %v\n", p2.merkleHash[:4])
-			add = append(add, Delta{key: p2.timestamp, typ: "add", source: "", target: p2.data})
+			if removing {
+				add = append(add, Delta{key: p2.key, typ: "remove", source: p2.value})
+			} else {
+				add = append(add, Delta{key: p2.key, typ: "add", target: p2.value})
+			}
 		}
 	}
 	emitAddAll := func(p2 Iter) {
@@ -655,7 +789,6 @@ func Diff(source, target *Tree) (out DeltaTrio) {
 		moreNodes2 := []Iter{}
 
 		for l, r := nodes1.Current(), nodes2.Current(); l != nil && r != nil; {
-			fmt.Printf("L%d l=%v r=%v key %q %q\n", level, l.merkleHash[:4], r.merkleHash[:4], l.timestamp, r.timestamp)
 			switch l.CompareKey(r) {
 			case -1: // l < r
 				// the r subtree is missing, push it down or add if we're on level0
@@ -686,9 +819,6 @@ func Diff(source, target *Tree) (out DeltaTrio) {
 			}
 		}
 
-		fmt.Printf("nodes1 %v\n", nodes1.Current())
-		fmt.Printf("nodes2 %v\n", nodes2.Current())
-
 		for l := nodes1.Current(); l != nil; l = nodes1.Left() {
 			if l.level > 0 {
 				moreNodes1 = append(moreNodes1, &Boundary{Iter: l.down.Iter()})
@@ -728,42 +858,38 @@ func Diff(source, target *Tree) (out DeltaTrio) {
 
 	add = []Delta{}
 	update = nil
+	removing = true
 	diffAtLevel(t.Iter(), s.Iter(), s.level)
 	out.Remove = add
+	out.SourceRoot, out.TargetRoot = source.Root().merkleHash, target.Root().merkleHash
 	return out
 }
 
+// SerializeLevel0 stores the entries of level0 under their level prefixed
+// keys. The tail is not stored: it would collide with an empty key.
 func (t *Tree) SerializeLevel0(onto KV) error {
 	level := t.levels[0]
-	for n := level.tail; n != nil; n = n.left {
-		key := n.Key()
-		value := n.Value()
-		err := onto.Set([]byte(key), []byte(value))
+	for n := level.tail.left; n != nil; n = n.left {
+		err := onto.Set(n.EncodedKey(), n.EncodedValue())
 		if err != nil {
 			return err
 		}
 	}
-	return onto.Set([]byte("root"), []byte(t.Root().Key()))
+	return onto.Set([]byte("root"), t.Root().EncodedKey())
 }
 
 func DeserializeLevel0(kv KV) (*Tree, error) {
 	cur := kv.Cursor()
-	start := StrEncodeKey(0, "")
-	cur.Goto([]byte(start))
+	start := EncodeKey(0, nil)
+	cur.Goto(start)
 	level0 := []*Message{}
-	for ; strings.HasPrefix(string(cur.Key()), start); cur.Next() {
-		encodedKey := cur.Key()
-		encodedValue := cur.Value()
-		_, key := StrDecodeKey(string(encodedKey))
-		_, value := StrDecodeValue(string(encodedValue))
-		// intKey := MustAtoi(key)
-		if IsTailKey(key) {
-			continue
-		}
-		m := &Message{timestamp: key, data: value}
+	for ; bytes.HasPrefix(cur.Key(), start); cur.Next() {
+		_, key := DecodeKey(cur.Key())
+		_, value := DecodeValue(cur.Value())
+		m := &Message{key: key, value: value}
 		level0 = append(level0, m)
 	}
-	return NewTree(level0), nil
+	return NewTree(level0, nil), nil
 }
 
 func MustAtoi(s string) int {
@@ -786,83 +912,266 @@ func (kv *CountingKV) Get(key []byte) ([]byte, bool, error) {
 	kv.stats["get"]++
 	return kv.KV.Get(key)
 }
+func (kv *CountingKV) Delete(key []byte) error {
+	kv.stats["delete"]++
+	return kv.KV.Delete(key)
+}
+func (kv *CountingKV) CompareAndSwap(key []byte, old []byte, value []byte) (bool, error) {
+	kv.stats["cas"]++
+	return kv.KV.CompareAndSwap(key, old, value)
+}
 func (kv *CountingKV) String() string { return fmt.Sprintf("CountingKV{stats=%v}", kv.stats) }
 
+// RootPrefix starts the KV keys that hold the root hash of each generation.
+const RootPrefix = "root:"
+
+func rootKey(gen int) string { return fmt.Sprintf("%s%d", RootPrefix, gen) }
+
+// HasherKey names the KV entry that records the hasher of every tree in the
+// store. Trees written with different hashers can't share nodes or be
+// diffed, so a store holds a single one.
+const HasherKey = "hasher"
+
+var ErrHasherMismatch = errors.New("hasher does not match the store")
+
+// storedHasher returns the hasher recorded in kv and whether there was one.
+// The first tree written to a store records it.
+func storedHasher(kv KV) (Hasher, bool, error) {
+	name, found, err := kv.Get([]byte(HasherKey))
+	if err != nil || !found {
+		return nil, false, err
+	}
+	h, err := HasherByName(string(name))
+	return h, true, err
+}
+
+// loadHasher is storedHasher for readers, which need the store to hold a tree.
+func loadHasher(kv KV) (Hasher, error) {
+	h, found, err := storedHasher(kv)
+	if err == nil && !found {
+		err = fmt.Errorf("%w: %q", ErrConfigMissing, HasherKey)
+	}
+	return h, err
+}
+
 func (t *Tree) SerializeWithKids(gen int, onto KV) error {
+	if err := t.writeNodes(onto); err != nil {
+		return err
+	}
+	config, err := json.Marshal(t.config)
+	if err != nil {
+		return err
+	}
+	if err := onto.Set([]byte(configKey(gen)), config); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(generationMeta{Created: time.Now().UTC(), Entries: t.Len(), Height: t.Height()})
+	if err != nil {
+		return err
+	}
+	if err := onto.Set([]byte(metaKey(gen)), meta); err != nil {
+		return err
+	}
+	rootKeyName := rootKey(gen)
+	root := t.Root().merkleHash
+	return onto.Set([]byte(rootKeyName), root[:])
+}
+
+// writeNodes writes every node of the tree keyed by its hash.
+func (t *Tree) writeNodes(onto KV) error {
+	if err := recordHasher(onto, t.config.Hasher); err != nil {
+		return err
+	}
 	for _, level := range t.levels {
 		for n := level.tail; n != nil; n = n.left {
-			key := StrEncodeKeyWithKids(n.merkleHash)
-			value := StrEncodeValueWithKids(n.level, n.ListKids(), n.timestamp, n.data)
-			err := onto.Set([]byte(key), []byte(value))
+			err := onto.Set(n.KeyWithKids(), n.ValueWithKids())
 			if err != nil {
 				return err
 			}
 		}
 	}
-	rootKeyName := fmt.Sprintf("root:%d", gen)
-	return onto.Set([]byte(rootKeyName), []byte(t.Root().merkleHash))
+	return nil
+}
+
+// recordHasher stores the name of hasher in onto, unless onto already holds
+// nodes of another hasher.
+func recordHasher(onto KV, hasher Hasher) error {
+	h, found, err := storedHasher(onto)
+	if err != nil {
+		return err
+	}
+	if found && h.Name() != hasher.Name() {
+		return fmt.Errorf("%w: tree uses %q, store uses %q", ErrHasherMismatch, hasher.Name(), h.Name())
+	}
+	if found {
+		return nil
+	}
+	return onto.Set([]byte(HasherKey), []byte(hasher.Name()))
 }
 
+// DeserializeWithKids loads generation gen with the config it was written
+// with. Rebuilding the tree must reproduce the stored root hash, otherwise the
+// stored config doesn't describe the stored nodes and ErrConfigMismatch is
+// returned. The content of the nodes is trusted, so a corrupted node shows up
+// as a config mismatch at best; use DeserializeWithKidsVerified to find it.
 func DeserializeWithKids(gen int, kv KV) (*Tree, error) {
-	rootKeyName := fmt.Sprintf("root:%d", gen)
+	return deserializeWithKids(gen, kv, false)
+}
+
+// DeserializeWithKidsVerified is DeserializeWithKids that recomputes the hash
+// of every stored node from its kids or its key and value, bottom up. The
+// first node that doesn't hash to the hash it is stored under is reported as
+// an *IntegrityError.
+func DeserializeWithKidsVerified(gen int, kv KV) (*Tree, error) {
+	return deserializeWithKids(gen, kv, true)
+}
+
+var ErrNodeMissing = errors.New("node not found")
+
+// IntegrityError points at a stored node of generation Gen, or of Ref when
+// the tree was loaded by ref, that is missing, can't be decoded (Err is set)
+// or whose content hashes to Computed instead of Hash.
+type IntegrityError struct {
+	Gen      int
+	Ref      string
+	Level    int8
+	Hash     Hash
+	Computed Hash
+	Err      error
+}
+
+func (e *IntegrityError) where() string {
+	if e.Ref != "" {
+		return "ref " + e.Ref
+	}
+	return fmt.Sprintf("generation %d", e.Gen)
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: node %s: %v", e.where(), e.Hash, e.Err)
+	}
+	return fmt.Sprintf("%s: level %d node %s hashes to %s", e.where(), e.Level, e.Hash, e.Computed)
+}
+
+func (e *IntegrityError) Unwrap() error { return e.Err }
+
+func deserializeWithKids(gen int, kv KV, verify bool) (*Tree, error) {
+	rootKeyName := rootKey(gen)
 	kvKey, found, err := kv.Get([]byte(rootKeyName))
-	mustNil(err)
-	mustTrue(found, "root key not found: %q", rootKeyName)
-	hashes := []string{string(kvKey)}
-	nextHashes := []string{}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("generation %d: %q: %w", gen, rootKeyName, ErrNodeMissing)
+	}
+	root, err := HashFromBytes(kvKey)
+	if err != nil {
+		return nil, fmt.Errorf("generation %d: %w", gen, err)
+	}
+	config, err := loadConfig(gen, kv)
+	if err != nil {
+		return nil, err
+	}
+	return loadTree(kv, root, config, verify, IntegrityError{Gen: gen})
+}
+
+// loadTree reads the tree below root. Errors are reported at the generation
+// or ref of at.
+func loadTree(kv KV, root Hash, config *TreeConfig, verify bool, at IntegrityError) (*Tree, error) {
+	failure := func(level int8, hash Hash, err error) *IntegrityError {
+		e := at
+		e.Level, e.Hash, e.Err = level, hash, err
+		return &e
+	}
+	var checks [][]*IntegrityError // levels from the root down
+	hashes := []Hash{root}
+	nextHashes := []Hash{}
 	messages := []*Message{}
 	for len(hashes) > 0 {
+		var level []*IntegrityError
 		for _, key := range hashes {
-			value, found, err := kv.Get([]byte(key))
-			mustNil(err)
-			mustTrue(found, "key not found: %q", key)
-			kidLevel, kids, kidKey, data := StrDecodeValueWithKids(string(value))
+			value, found, err := kv.Get(EncodeKeyWithKids(key))
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				return nil, failure(0, key, ErrNodeMissing)
+			}
+			kidLevel, isTail, kids, kidKey, kidValue, err := DecodeValueWithKids(value)
+			if err != nil {
+				return nil, failure(0, key, err)
+			}
 			if kidLevel == 0 {
-				if !IsTailKey(kidKey) {
-					messages = append(messages, &Message{timestamp: kidKey, data: data})
+				if !isTail {
+					messages = append(messages, &Message{key: kidKey, value: kidValue})
 				}
 			} else {
 				nextHashes = append(nextHashes, kids...)
 			}
+			if verify {
+				check := failure(kidLevel, key, nil)
+				if kidLevel == 0 {
+					check.Computed = LeafHash(config.Hasher, isTail, kidKey, kidValue)
+				} else {
+					ascending := slices.Clone(kids)
+					slices.Reverse(ascending) // kids are stored right to left
+					check.Computed = bucketHashOf(config.Hasher, kidLevel, ascending)
+				}
+				level = append(level, check)
+			}
 		}
-		hashes, nextHashes = nextHashes, []string{}
+		checks = append(checks, level)
+		hashes, nextHashes = nextHashes, []Hash{}
 	}
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].timestamp < messages[j].timestamp
-	})
-	return NewTree(messages), nil
+	for i := len(checks) - 1; i >= 0; i-- {
+		for _, check := range checks[i] {
+			if check.Computed != check.Hash {
+				return nil, check
+			}
+		}
+	}
+	tree := NewTree(messages, config)
+	if tree.Root().merkleHash != root {
+		return nil, fmt.Errorf("%w: %s has root %s, %v rebuilds %s", ErrConfigMismatch, at.where(), root, config, tree.Root().merkleHash)
+	}
+	return tree, nil
 }
 
-func (t *Tree) SerializeJSON(gen int, w1 io.Writer) error {
-	w := &strings.Builder{}
-	fmt.Fprintf(w, "{\"gen\":%d,\"root\":\"%s\",\"nodes\":[", gen, t.Root().merkleHash)
+type jsonNode struct {
+	Hash  Hash   `json:"hash"`
+	Level int8   `json:"level"`
+	Tail  bool   `json:"tail,omitempty"`
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Kids  []Hash `json:"kids"`
+}
 
-	first := true
+// SerializeJSON writes every node of the tree as a single JSON document.
+// Hashes are hex encoded, keys and values base64 encoded.
+func (t *Tree) SerializeJSON(gen int, w io.Writer) error {
+	doc := struct {
+		Gen   int        `json:"gen"`
+		Root  Hash       `json:"root"`
+		Nodes []jsonNode `json:"nodes"`
+	}{Gen: gen, Root: t.Root().merkleHash, Nodes: []jsonNode{}}
 	for _, level := range t.levels {
 		for n := level.tail; n != nil; n = n.left {
-			if !first {
-				fmt.Fprint(w, ",")
-			}
-			first = false
-
 			kids := n.ListKids()
-			kidsJSON := "["
-			for i, kid := range kids {
-				if i > 0 {
-					kidsJSON += ","
-				}
-				kidsJSON += "\"" + kid + "\""
+			if kids == nil {
+				kids = []Hash{}
 			}
-			kidsJSON += "]"
-
-			fmt.Fprintf(w, "{\"hash\":\"%s\",\"level\":%d,\"timestamp\":%s,\"data\":\"%s\",\"kids\":%s}",
-				n.merkleHash, n.level, n.timestamp, n.data, kidsJSON)
+			doc.Nodes = append(doc.Nodes, jsonNode{
+				Hash:  n.merkleHash,
+				Level: n.level,
+				Tail:  n.isTail,
+				Key:   n.key,
+				Value: n.value,
+				Kids:  kids,
+			})
 		}
 	}
-
-	fmt.Fprint(w, "]}")
-	_, err := w1.Write([]byte(w.String()))
-	return err
+	return json.NewEncoder(w).Encode(doc)
 }
 
 // func (this *Tree) GetNode(level int8, key []byte) (*Node, error) {
@@ -881,11 +1190,6 @@ func (t *Tree) SerializeJSON(gen int, w1 io.Writer) error {
 // 	return this.kv.Set(entry_key, entry_value)
 // }
 
-// func (this *Tree) Get(key []byte) ([]byte, error) {
-// 	panic("not implemented")
-// 	// return this.kv.Get(key)
-// }
-
 // type Iter func(cb func(key []byte, value []byte) error) error
 
 // func sortedKeys(m map[string]string) []string {
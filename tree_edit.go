@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Put inserts or replaces the value stored under key. Only the buckets on the
+// path from the touched level0 node to the root are rehashed. The tree keeps
+// its own copies of key and value.
+func (t *Tree) Put(key []byte, value []byte) {
+	n := t.seek(key)
+	if n.compareTo(key) == 0 {
+		if bytes.Equal(n.value, value) {
+			return
+		}
+		n.setValue(bytes.Clone(value))
+		t.propagate(levelEdits{changed: []*Node{n}})
+		return
+	}
+	node := NewNode(bytes.Clone(key), bytes.Clone(value), false, t.config)
+	t.levels[0].insertBefore(node, n)
+	t.propagate(levelEdits{changed: []*Node{node}})
+}
+
+// Delete removes key from the tree and reports whether it was present.
+func (t *Tree) Delete(key []byte) bool {
+	n := t.seek(key)
+	if n.compareTo(key) != 0 {
+		return false
+	}
+	t.levels[0].unlink(n)
+	t.propagate(levelEdits{removed: []*Node{n}})
+	return true
+}
+
+// levelEdits describes how a mutation touched a single level.
+type levelEdits struct {
+	changed []*Node // inserted nodes and nodes whose merkle hash changed
+	removed []*Node // nodes that have already been unlinked from the level
+}
+
+func (e levelEdits) empty() bool { return len(e.changed) == 0 && len(e.removed) == 0 }
+
+// propagate carries the edits of level0 up the tree: boundary nodes are
+// promoted or demoted, affected parents are rehashed, and levels are added or
+// dropped at the top so that the result matches a tree built from scratch.
+func (t *Tree) propagate(edits levelEdits) {
+	for l := 0; l < len(t.levels); l++ {
+		if l == len(t.levels)-1 {
+			if !t.levels[l].OnlyTail() {
+				t.levels = append(t.levels, NextLevel(t.levels[l]))
+			}
+			edits = levelEdits{}
+			continue
+		}
+		if edits.empty() {
+			break
+		}
+		edits = t.reconcile(l, edits)
+	}
+	t.shrink()
+}
+
+// reconcile applies the edits of level l to level l+1 and returns the edits
+// that level l+1 underwent as a result.
+func (t *Tree) reconcile(l int, edits levelEdits) (next levelEdits) {
+	upper := t.levels[l+1]
+	var anchors []*Node // nodes whose enclosing bucket has to be rehashed
+	var starts []*Node  // nodes from which boundaries have to be decided again
+
+	for _, r := range edits.removed {
+		anchors = append(anchors, r.right)
+		starts = append(starts, r.right)
+		if r.up != nil {
+			upper.unlink(r.up)
+			next.removed = append(next.removed, r.up)
+		}
+	}
+	for _, n := range edits.changed {
+		anchors = append(anchors, n)
+		starts = append(starts, n)
+	}
+
+	// A chunker may take the chunk size into account, so a changed decision
+	// can flip the decisions on its right. Walk right until a node that was a
+	// boundary before and still is one: from there on nothing can differ.
+	starts = slices.DeleteFunc(starts, func(n *Node) bool { return !n.linked() })
+	sort.Slice(starts, func(i, j int) bool { return starts[i].CompareKey(starts[j]) < 0 })
+	decided := map[*Node]bool{}
+	var promote []*Node
+	for _, start := range starts {
+		for p := start; !decided[p]; p = p.right {
+			decided[p] = true
+			p.boundary = nil
+			boundary, had := p.IsBoundary(), p.up != nil
+			if boundary && had {
+				break
+			}
+			if boundary && !had {
+				promote = append(promote, p)
+			} else if !boundary && had {
+				upper.unlink(p.up)
+				next.removed = append(next.removed, p.up)
+				p.up = nil
+				anchors = append(anchors, p)
+			}
+		}
+	}
+
+	// right to left, so that the next boundary on the right already has its up node
+	sort.Slice(promote, func(i, j int) bool { return promote[i].CompareKey(promote[j]) > 0 })
+	for _, n := range promote {
+		up := n.CreateHigherLevel()
+		upper.insertBefore(up, n.right.nextUp())
+		next.changed = append(next.changed, up)
+		anchors = append(anchors, n.right)
+	}
+
+	dirty := map[*Node]bool{}
+	for _, a := range anchors {
+		if a != nil && a.linked() {
+			dirty[a.nextUp()] = true
+		}
+	}
+	for p := range dirty {
+		old := p.merkleHash
+		p.rehash()
+		if !old.IsZero() && old != p.merkleHash {
+			next.changed = append(next.changed, p)
+		}
+	}
+	return next
+}
+
+// shrink drops the top levels that no longer carry anything but the tail.
+func (t *Tree) shrink() {
+	for len(t.levels) > 1 && t.levels[len(t.levels)-2].OnlyTail() {
+		t.levels = t.levels[:len(t.levels)-1]
+		t.levels[len(t.levels)-1].tail.up = nil
+	}
+}
+
+func (l *Level) insertBefore(n *Node, at *Node) {
+	n.left, n.right = at.left, at
+	if at.left != nil {
+		at.left.right = n
+	}
+	at.left = n
+	l.size++
+}
+
+// unlink removes n from the level. The links of n itself are kept so that
+// callers can still find its former neighbours.
+func (l *Level) unlink(n *Node) {
+	if n.left != nil {
+		n.left.right = n.right
+	}
+	n.right.left = n.left
+	l.size--
+}
+
+// linked reports whether n is still part of its level.
+func (n *Node) linked() bool {
+	return n.isTail || (n.right != nil && n.right.left == n)
+}
+
+// nextUp returns the parent of the bucket n belongs to, i.e. the up node of
+// the first boundary at or to the right of n.
+func (n *Node) nextUp() *Node {
+	p := n
+	for p.up == nil {
+		p = p.right
+	}
+	return p.up
+}
+
+func (n *Node) setValue(value []byte) {
+	n.value = value
+	n.merkleHash = LeafHash(n.config.Hasher, n.isTail, n.key, value)
+	n.boundary = nil
+}
+
+// rehash recomputes the merkle hash of n. A changed node is reported to the
+// next reconcile, which decides its boundary again.
+func (n *Node) rehash() {
+	old := n.merkleHash
+	n.merkleHash = Hash{}
+	n.FillMerkleHash()
+	if n.merkleHash != old {
+		n.boundary = nil
+	}
+}
+
+// Batch collects puts and deletes that are applied to a Tree in one pass.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func NewBatch() *Batch { return &Batch{} }
+
+// Put records an insert or update. The batch keeps its own copies of key and
+// value.
+func (b *Batch) Put(key []byte, value []byte) *Batch {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), value: bytes.Clone(value)})
+	return b
+}
+
+func (b *Batch) Delete(key []byte) *Batch {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), delete: true})
+	return b
+}
+
+func (b *Batch) Len() int { return len(b.ops) }
+
+// sorted returns the operations ordered by key. When a key is mentioned more
+// than once, the operation added last wins.
+func (b *Batch) sorted() []batchOp {
+	ops := slices.Clone(b.ops)
+	sort.SliceStable(ops, func(i, j int) bool { return bytes.Compare(ops[i].key, ops[j].key) < 0 })
+	out := ops[:0]
+	for i, op := range ops {
+		if i+1 < len(ops) && bytes.Equal(ops[i+1].key, op.key) {
+			continue
+		}
+		out = append(out, op)
+	}
+	return out
+}
+
+// Apply performs all operations of the batch. Level0 is edited first and the
+// changes are then carried up the tree level by level, so every dirty parent
+// is rehashed exactly once no matter how many of its kids were touched.
+func (t *Tree) Apply(b *Batch) {
+	ops := b.sorted()
+	// locate everything before editing: seek relies on consistent upper levels
+	at := make([]*Node, len(ops))
+	for i, op := range ops {
+		at[i] = t.seek(op.key)
+	}
+	var edits levelEdits
+	for i, op := range ops {
+		n := at[i]
+		found := n.compareTo(op.key) == 0
+		switch {
+		case op.delete && found:
+			t.levels[0].unlink(n)
+			edits.removed = append(edits.removed, n)
+		case op.delete:
+		case found:
+			if !bytes.Equal(n.value, op.value) {
+				n.setValue(op.value)
+				edits.changed = append(edits.changed, n)
+			}
+		default:
+			// keys ascend, so a later insert in front of the same node lands after this one
+			node := NewNode(op.key, op.value, false, t.config)
+			t.levels[0].insertBefore(node, n)
+			edits.changed = append(edits.changed, node)
+		}
+	}
+	if !edits.empty() {
+		t.propagate(edits)
+	}
+}
+
+var ErrPatch = errors.New("patch does not apply")
+
+// Patch applies a DeltaTrio produced by Diff(source, target) to a tree equal
+// to source, turning it into target. Every delta is checked against the
+// current contents first: an add requires the key to be absent, an update or
+// a remove requires the key to hold the source value, and no key may appear in
+// more than one delta. When the deltas carry
+// the roots they were made between, the tree must have the source root and
+// end up with the target root. When any check fails, an error wrapping
+// ErrPatch is returned and the tree is left untouched.
+func (t *Tree) Patch(d DeltaTrio) error {
+	seen := map[string]bool{}
+	for _, delta := range slices.Concat(d.Add, d.Update, d.Remove) {
+		if seen[string(delta.key)] {
+			return fmt.Errorf("%w: key %q appears in more than one delta", ErrPatch, delta.key)
+		}
+		seen[string(delta.key)] = true
+	}
+	batch, undo := NewBatch(), NewBatch()
+	for _, delta := range d.Add {
+		if _, found := t.Get(delta.key); found {
+			return fmt.Errorf("%w: add of existing key %q", ErrPatch, delta.key)
+		}
+		batch.Put(delta.key, delta.target)
+		undo.Delete(delta.key)
+	}
+	for _, delta := range d.Update {
+		if err := t.expect(delta); err != nil {
+			return err
+		}
+		batch.Put(delta.key, delta.target)
+		undo.Put(delta.key, delta.source)
+	}
+	for _, delta := range d.Remove {
+		if err := t.expect(delta); err != nil {
+			return err
+		}
+		batch.Delete(delta.key)
+		undo.Put(delta.key, delta.source)
+	}
+	if root := t.Root().merkleHash; !d.SourceRoot.IsZero() && root != d.SourceRoot {
+		return fmt.Errorf("%w: tree has root %s, deltas apply to %s", ErrPatch, root, d.SourceRoot)
+	}
+	t.Apply(batch)
+	if root := t.Root().merkleHash; !d.TargetRoot.IsZero() && root != d.TargetRoot {
+		t.Apply(undo)
+		return fmt.Errorf("%w: deltas produce root %s, expected %s", ErrPatch, root, d.TargetRoot)
+	}
+	return nil
+}
+
+// Unpatch reverts a DeltaTrio previously applied with Patch.
+func (t *Tree) Unpatch(d DeltaTrio) error { return t.Patch(d.Reverse()) }
+
+func (t *Tree) expect(delta Delta) error {
+	value, found := t.Get(delta.key)
+	if !found {
+		return fmt.Errorf("%w: %s of missing key %q", ErrPatch, delta.typ, delta.key)
+	}
+	if !bytes.Equal(value, delta.source) {
+		return fmt.Errorf("%w: %s of key %q expected %q, found %q", ErrPatch, delta.typ, delta.key, delta.source, value)
+	}
+	return nil
+}
+
+// Reverse returns the deltas that turn the target of d back into its source.
+func (d DeltaTrio) Reverse() DeltaTrio {
+	out := DeltaTrio{Add: []Delta{}, Remove: []Delta{}, Update: []Delta{}, SourceRoot: d.TargetRoot, TargetRoot: d.SourceRoot}
+	for _, delta := range d.Remove {
+		out.Add = append(out.Add, Delta{key: delta.key, typ: "add", target: delta.source})
+	}
+	for _, delta := range d.Add {
+		out.Remove = append(out.Remove, Delta{key: delta.key, typ: "remove", source: delta.target})
+	}
+	for _, delta := range d.Update {
+		out.Update = append(out.Update, Delta{key: delta.key, typ: "update", source: delta.target, target: delta.source})
+	}
+	return out
+}
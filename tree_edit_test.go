@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func messagesOf(m map[string]string) []*Message {
+	out := []*Message{}
+	for k, v := range m {
+		out = append(out, NewMessage([]byte(k), []byte(v)))
+	}
+	return out
+}
+
+func requireSameTree(t *testing.T, want map[string]string, tree *Tree) {
+	requireSameTreeWith(t, DefaultTreeConfig(), want, tree)
+}
+
+func requireSameTreeWith(t *testing.T, config *TreeConfig, want map[string]string, tree *Tree) {
+	expected := NewTree(messagesOf(want), config)
+	require.Equal(t, boundaries(expected), boundaries(tree))
+	require.NotContains(t, boundaries(tree), "?")
+	require.Equal(t, expected.String(), tree.String())
+	require.Equal(t, expected.Root().merkleHash, tree.Root().merkleHash)
+}
+
+// boundaries lists the cached boundary decisions of every level without
+// deciding anything: B for a boundary, - for none, ? for undecided.
+func boundaries(tree *Tree) string {
+	var out []byte
+	for _, level := range tree.levels {
+		for n := level.tail; n != nil; n = n.left {
+			switch {
+			case n.isTail:
+				out = append(out, 'T')
+			case n.boundary == nil:
+				out = append(out, '?')
+			case *n.boundary:
+				out = append(out, 'B')
+			default:
+				out = append(out, '-')
+			}
+		}
+		out = append(out, '\n')
+	}
+	return string(out)
+}
+
+func TestPutDelete(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	tree := NewTree(nil, nil)
+	want := map[string]string{}
+	for range 3000 {
+		key := strconv.Itoa(rnd.IntN(300))
+		if rnd.IntN(3) == 0 {
+			_, found := want[key]
+			require.Equal(t, found, tree.Delete([]byte(key)))
+			delete(want, key)
+		} else {
+			value := fmt.Sprintf("value %d", rnd.IntN(3))
+			tree.Put([]byte(key), []byte(value))
+			want[key] = value
+		}
+		requireSameTree(t, want, tree)
+	}
+	for key := range want {
+		require.True(t, tree.Delete([]byte(key)))
+	}
+	requireSameTree(t, map[string]string{}, tree)
+	require.Equal(t, 1, tree.Height())
+}
+
+func TestApply(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(3, 4))
+	tree := NewTree(generate1(100), nil)
+	want := map[string]string{}
+	for _, m := range generate1(100) {
+		want[string(m.key)] = string(m.value)
+	}
+	for range 200 {
+		batch := NewBatch()
+		for range rnd.IntN(30) {
+			key := strconv.Itoa(rnd.IntN(500))
+			if rnd.IntN(3) == 0 {
+				batch.Delete([]byte(key))
+				delete(want, key)
+			} else {
+				value := fmt.Sprintf("value %d", rnd.IntN(3))
+				batch.Put([]byte(key), []byte(value))
+				want[key] = value
+			}
+		}
+		tree.Apply(batch)
+		requireSameTree(t, want, tree)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	source := mapOf(generateSorted(300))
+	target := maps.Clone(source)
+	delete(target, "0005")
+	delete(target, "0150")
+	target["0007"] = "updated"
+	target["0299"] = "updated"
+	target["1000"] = "added"
+	target["00005"] = "added"
+
+	sourceTree := NewTree(messagesOf(source), nil)
+	targetTree := NewTree(messagesOf(target), nil)
+	d := Diff(sourceTree, targetTree)
+
+	tree := NewTree(messagesOf(source), nil)
+	require.Nil(t, tree.Patch(d))
+	require.Equal(t, targetTree.Root().merkleHash, tree.Root().merkleHash)
+	requireSameTree(t, target, tree)
+
+	require.ErrorIs(t, tree.Patch(d), ErrPatch)
+	requireSameTree(t, target, tree)
+
+	require.Nil(t, tree.Unpatch(d))
+	require.Equal(t, sourceTree.Root().merkleHash, tree.Root().merkleHash)
+
+	tree.Put([]byte("0007"), []byte("concurrent edit"))
+	err := tree.Patch(d)
+	require.ErrorIs(t, err, ErrPatch)
+	require.Contains(t, err.Error(), "0007")
+	value, _ := tree.Get([]byte("0007"))
+	require.Equal(t, []byte("concurrent edit"), value)
+
+	tree.Delete([]byte("0150"))
+	tree.Put([]byte("0007"), []byte(source["0007"]))
+	require.ErrorIs(t, tree.Patch(d), ErrPatch)
+
+	// the touched keys agree with the source, the rest of the tree doesn't
+	tree = NewTree(messagesOf(source), nil)
+	tree.Put([]byte("0100"), []byte("elsewhere"))
+	err = tree.Patch(d)
+	require.ErrorIs(t, err, ErrPatch)
+	require.Contains(t, err.Error(), "deltas apply to")
+
+	// deltas that don't lead to the target they claim
+	tree = NewTree(messagesOf(source), nil)
+	forged := d
+	forged.TargetRoot = sourceTree.Root().merkleHash
+	err = tree.Patch(forged)
+	require.ErrorIs(t, err, ErrPatch)
+	require.Equal(t, sourceTree.Root().merkleHash, tree.Root().merkleHash)
+
+	// deltas that name a key twice, without roots to catch them
+	add := Delta{key: []byte("new"), typ: "add", target: []byte("1")}
+	update := Delta{key: []byte("0007"), typ: "update", source: []byte(source["0007"]), target: []byte("1")}
+	remove := Delta{key: []byte("0007"), typ: "remove", source: []byte(source["0007"])}
+	for _, twice := range []DeltaTrio{
+		{Add: []Delta{add, add}},
+		{Add: []Delta{{key: update.key, typ: "add", target: []byte("2")}}, Update: []Delta{update}},
+		{Update: []Delta{update}, Remove: []Delta{remove}},
+	} {
+		err = tree.Patch(twice)
+		require.ErrorIs(t, err, ErrPatch)
+		require.Contains(t, err.Error(), "more than one delta")
+		require.Equal(t, sourceTree.Root().merkleHash, tree.Root().merkleHash)
+	}
+}
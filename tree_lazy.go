@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// StoredNode is a node as written by SerializeWithKids: it is addressed by its
+// merkle hash and refers to its kids by their hashes. Nodes of a snapshot
+// also hold their kids in memory. Stored nodes are never modified, so
+// versions share the subtrees they have in common.
+type StoredNode struct {
+	hash   Hash
+	level  int8
+	tail   bool
+	kids   []Hash        // in ascending key order
+	loaded []*StoredNode // the kids themselves, nil when they are read from a KV
+	key    []byte
+	value  []byte
+}
+
+func (n *StoredNode) isTail() bool { return n.tail }
+
+// compareTo compares the key of n with key, the tail being the largest key.
+func (n *StoredNode) compareTo(key []byte) int {
+	if n.tail {
+		return 1
+	}
+	return bytes.Compare(n.key, key)
+}
+
+func (n *StoredNode) String() string {
+	return fmt.Sprintf("StoredNode(key=%q, level=%d, kids=%d)", n.key, n.level, len(n.kids))
+}
+
+// NodeCache keeps the most recently used stored nodes. It is safe for
+// concurrent use, so several lazy trees over the same KV may share one.
+type NodeCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // front is the most recently used
+	items map[Hash]*list.Element
+}
+
+func NewNodeCache(size int) *NodeCache {
+	return &NodeCache{size: size, order: list.New(), items: map[Hash]*list.Element{}}
+}
+
+func (c *NodeCache) Get(hash Hash) (*StoredNode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[hash]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*StoredNode), true
+}
+
+func (c *NodeCache) Add(n *StoredNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[n.hash]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[n.hash] = c.order.PushFront(n)
+	for c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.items, last.Value.(*StoredNode).hash)
+	}
+}
+
+func (c *NodeCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+const DefaultNodeCacheSize = 1024
+
+// LazyTree is a read-only view of a tree stored in a KV. Nodes are fetched by
+// their merkle hash only when a traversal reaches them. A snapshot is a
+// LazyTree whose nodes are all in memory.
+type LazyTree struct {
+	kv    KV
+	root  Hash
+	top   *StoredNode // the root node when it is in memory
+	cache *NodeCache
+}
+
+// NewLazyTree opens the tree below root. A nil cache means a private cache of
+// DefaultNodeCacheSize nodes.
+func NewLazyTree(kv KV, root Hash, cache *NodeCache) *LazyTree {
+	if cache == nil {
+		cache = NewNodeCache(DefaultNodeCacheSize)
+	}
+	return &LazyTree{kv: kv, root: root, cache: cache}
+}
+
+// OpenLazyTree opens the generation gen written by SerializeWithKids. A nil
+// cache is handled as in NewLazyTree.
+func OpenLazyTree(gen int, kv KV, cache *NodeCache) (*LazyTree, error) {
+	rootKeyName := rootKey(gen)
+	root, found, err := kv.Get([]byte(rootKeyName))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("generation %d: %q: %w", gen, rootKeyName, ErrNodeMissing)
+	}
+	hash, err := HashFromBytes(root)
+	if err != nil {
+		return nil, err
+	}
+	return NewLazyTree(kv, hash, cache), nil
+}
+
+func (t *LazyTree) RootHash() Hash { return t.root }
+
+func (t *LazyTree) Root() (*StoredNode, error) {
+	if t.top != nil {
+		return t.top, nil
+	}
+	return t.node(t.root)
+}
+
+// kid returns kid i of n.
+func (t *LazyTree) kid(n *StoredNode, i int) (*StoredNode, error) {
+	if n.loaded != nil {
+		return n.loaded[i], nil
+	}
+	return t.node(n.kids[i])
+}
+
+func (t *LazyTree) node(hash Hash) (*StoredNode, error) {
+	if n, ok := t.cache.Get(hash); ok {
+		return n, nil
+	}
+	value, found, err := t.kv.Get(EncodeKeyWithKids(hash))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("node %s: %w", hash, ErrNodeMissing)
+	}
+	n, err := decodeStoredNode(hash, value)
+	if err != nil {
+		return nil, err
+	}
+	t.cache.Add(n)
+	return n, nil
+}
+
+// decodeStoredNode decodes the value stored under hash by SerializeWithKids.
+func decodeStoredNode(hash Hash, value []byte) (*StoredNode, error) {
+	level, isTail, kids, key, data, err := DecodeValueWithKids(value)
+	if err != nil {
+		return nil, fmt.Errorf("node %s: %w", hash, err)
+	}
+	slices.Reverse(kids)
+	return &StoredNode{hash: hash, level: level, tail: isTail, kids: kids, key: key, value: data}, nil
+}
+
+// computeHash hashes the content of n the way FillMerkleHash does.
+func (n *StoredNode) computeHash(hasher Hasher) Hash {
+	if n.level == 0 {
+		return LeafHash(hasher, n.tail, n.key, n.value)
+	}
+	return bucketHashOf(hasher, n.level, n.kids)
+}
+
+// lowerBound returns the index of the first kid of n whose key is greater than
+// or equal to key, along with the kid itself.
+func (t *LazyTree) lowerBound(n *StoredNode, key []byte) (int, *StoredNode, error) {
+	for i := range n.kids {
+		kid, err := t.kid(n, i)
+		if err != nil {
+			return 0, nil, err
+		}
+		if kid.compareTo(key) >= 0 {
+			return i, kid, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("key %q is beyond %v", key, n)
+}
+
+func (t *LazyTree) Get(key []byte) ([]byte, bool, error) {
+	n, err := t.Root()
+	if err != nil {
+		return nil, false, err
+	}
+	for n.level > 0 {
+		if _, n, err = t.lowerBound(n, key); err != nil {
+			return nil, false, err
+		}
+	}
+	if n.compareTo(key) != 0 {
+		return nil, false, nil
+	}
+	return n.value, true, nil
+}
+
+// LazyRangeIter is the LazyTree counterpart of RangeIter. It keeps the path
+// from the root to the current entry, so stepping to a neighbour only loads
+// the nodes that the path does not cover yet. Traversal stops on the first
+// KV error, which is then reported by Err.
+type LazyRangeIter struct {
+	tree  *LazyTree
+	start []byte
+	end   []byte
+	path  []lazyFrame // path[i].n is at level height-1-i
+	leaf  *StoredNode
+	err   error
+}
+
+type lazyFrame struct {
+	n *StoredNode
+	i int // index of the kid the path continues with
+}
+
+func (t *LazyTree) Range(start []byte, end []byte) *LazyRangeIter {
+	return &LazyRangeIter{tree: t, start: start, end: end}
+}
+
+func (it *LazyRangeIter) Seek(key []byte) bool {
+	if bytes.Compare(key, it.start) < 0 {
+		key = it.start
+	}
+	return it.position(key) && it.settle()
+}
+
+func (it *LazyRangeIter) First() bool { return it.Seek(it.start) }
+
+func (it *LazyRangeIter) Last() bool {
+	ok := false
+	if len(it.end) == 0 {
+		n, found := it.reset()
+		ok = found && it.descend(n, true)
+	} else {
+		ok = it.position(it.end)
+	}
+	return ok && it.step(-1) && it.settle()
+}
+
+func (it *LazyRangeIter) Next() bool { return it.leaf != nil && it.step(1) && it.settle() }
+func (it *LazyRangeIter) Prev() bool { return it.leaf != nil && it.step(-1) && it.settle() }
+
+func (it *LazyRangeIter) Valid() bool   { return it.leaf != nil }
+func (it *LazyRangeIter) Key() []byte   { return it.leaf.key }
+func (it *LazyRangeIter) Value() []byte { return it.leaf.value }
+func (it *LazyRangeIter) Err() error    { return it.err }
+
+// position points the path at the first entry whose key is greater than or
+// equal to key, regardless of the range.
+func (it *LazyRangeIter) position(key []byte) bool {
+	n, ok := it.reset()
+	for ok && n.level > 0 {
+		i, kid, err := it.tree.lowerBound(n, key)
+		if !it.check(err) {
+			return false
+		}
+		it.path = append(it.path, lazyFrame{n: n, i: i})
+		n = kid
+	}
+	it.leaf = n
+	return ok
+}
+
+// settle drops the current entry when it lies outside of the range.
+func (it *LazyRangeIter) settle() bool {
+	if it.leaf.isTail() || !inRange(it.leaf.key, it.start, it.end) {
+		it.path, it.leaf = it.path[:0], nil
+		return false
+	}
+	return true
+}
+
+func (it *LazyRangeIter) reset() (*StoredNode, bool) {
+	it.path, it.leaf = it.path[:0], nil
+	n, err := it.tree.Root()
+	return n, it.check(err)
+}
+
+// step moves the path to the neighbouring leaf in direction dir.
+func (it *LazyRangeIter) step(dir int) bool {
+	for d := len(it.path) - 1; d >= 0; d-- {
+		f := &it.path[d]
+		if i := f.i + dir; i >= 0 && i < len(f.n.kids) {
+			f.i = i
+			kid, err := it.tree.kid(f.n, i)
+			if !it.check(err) {
+				return false
+			}
+			it.path = it.path[:d+1]
+			return it.descend(kid, dir < 0)
+		}
+	}
+	it.path, it.leaf = it.path[:0], nil
+	return false
+}
+
+// descend follows the leftmost (or rightmost) kids of n down to level0.
+func (it *LazyRangeIter) descend(n *StoredNode, rightmost bool) bool {
+	for n.level > 0 {
+		i := 0
+		if rightmost {
+			i = len(n.kids) - 1
+		}
+		it.path = append(it.path, lazyFrame{n: n, i: i})
+		kid, err := it.tree.kid(n, i)
+		if !it.check(err) {
+			return false
+		}
+		n = kid
+	}
+	it.leaf = n
+	return true
+}
+
+func (it *LazyRangeIter) check(err error) bool {
+	if err != nil {
+		it.err = err
+		it.path, it.leaf = it.path[:0], nil
+		return false
+	}
+	return true
+}
+
+// DiffStored compares two generations written by SerializeWithKids without
+// loading either of them. Subtrees with equal merkle hashes are skipped, so
+// the number of nodes read is proportional to the size of the change.
+func DiffStored(kv KV, sourceGen int, targetGen int) (DeltaTrio, error) {
+	cache := NewNodeCache(DefaultNodeCacheSize)
+	source, err := OpenLazyTree(sourceGen, kv, cache)
+	if err != nil {
+		return DeltaTrio{}, err
+	}
+	target, err := OpenLazyTree(targetGen, kv, cache)
+	if err != nil {
+		return DeltaTrio{}, err
+	}
+	return DiffLazy(source, target)
+}
+
+// DiffLazy produces the same DeltaTrio as Diff for two lazily loaded trees.
+func DiffLazy(source, target *LazyTree) (out DeltaTrio, err error) {
+	out = DeltaTrio{Add: []Delta{}, Remove: []Delta{}, Update: []Delta{}, SourceRoot: source.root, TargetRoot: target.root}
+	s := &diffCursor{tree: source, frames: []diffFrame{{}}}
+	t := &diffCursor{tree: target, frames: []diffFrame{{}}}
+	for !s.done() && !t.done() {
+		l, err := s.node()
+		if err != nil {
+			return out, err
+		}
+		r, err := t.node()
+		if err != nil {
+			return out, err
+		}
+		switch {
+		case l.hash == r.hash:
+			s.next()
+			t.next()
+		case l.level > r.level:
+			s.descend(l)
+		case l.level < r.level:
+			t.descend(r)
+		case l.level > 0:
+			s.descend(l)
+			t.descend(r)
+		case r.isTail() || (!l.isTail() && bytes.Compare(l.key, r.key) < 0):
+			out.Remove = append(out.Remove, Delta{key: l.key, typ: "remove", source: l.value})
+			s.next()
+		case l.isTail() || bytes.Compare(l.key, r.key) > 0:
+			out.Add = append(out.Add, Delta{key: r.key, typ: "add", target: r.value})
+			t.next()
+		default:
+			out.Update = append(out.Update, Delta{key: r.key, typ: "update", source: l.value, target: r.value})
+			s.next()
+			t.next()
+		}
+	}
+	err = s.drain(func(n *StoredNode) {
+		out.Remove = append(out.Remove, Delta{key: n.key, typ: "remove", source: n.value})
+	})
+	if err != nil {
+		return out, err
+	}
+	err = t.drain(func(n *StoredNode) {
+		out.Add = append(out.Add, Delta{key: n.key, typ: "add", target: n.value})
+	})
+	return out, err
+}
+
+// diffCursor walks a stored tree in key order. The current node stands for
+// its whole subtree until the cursor is asked to descend into it.
+type diffCursor struct {
+	tree   *LazyTree
+	frames []diffFrame
+}
+
+type diffFrame struct {
+	parent *StoredNode // nil for the frame of the root
+	i      int
+}
+
+func (f diffFrame) size() int {
+	if f.parent == nil {
+		return 1
+	}
+	return len(f.parent.kids)
+}
+
+func (c *diffCursor) done() bool { return len(c.frames) == 0 }
+
+func (c *diffCursor) node() (*StoredNode, error) {
+	f := c.frames[len(c.frames)-1]
+	if f.parent == nil {
+		return c.tree.Root()
+	}
+	return c.tree.kid(f.parent, f.i)
+}
+
+// next moves past the current node. Parent frames already point past the
+// node that was descended into, so only exhausted frames are dropped.
+func (c *diffCursor) next() {
+	c.frames[len(c.frames)-1].i++
+	for len(c.frames) > 0 {
+		if f := c.frames[len(c.frames)-1]; f.i < f.size() {
+			return
+		}
+		c.frames = c.frames[:len(c.frames)-1]
+	}
+}
+
+// descend replaces the current node n with its kids.
+func (c *diffCursor) descend(n *StoredNode) {
+	c.next()
+	c.frames = append(c.frames, diffFrame{parent: n})
+}
+
+// drain reports every remaining level0 entry except the tail.
+func (c *diffCursor) drain(cb func(*StoredNode)) error {
+	for !c.done() {
+		n, err := c.node()
+		if err != nil {
+			return err
+		}
+		if n.level > 0 {
+			c.descend(n)
+			continue
+		}
+		if !n.isTail() {
+			cb(n)
+		}
+		c.next()
+	}
+	return nil
+}
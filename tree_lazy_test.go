@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazyTree(t *testing.T) {
+	tree := NewTree(generateSorted(1000), nil)
+	kv := NewKVFile()
+	kv.MustReset()
+	gen := 7
+	require.Nil(t, tree.SerializeWithKids(gen, kv))
+
+	counting := NewCountingKV(kv)
+	cache := NewNodeCache(16)
+	lazy, err := OpenLazyTree(gen, counting, cache)
+	require.Nil(t, err)
+	require.Equal(t, tree.Root().merkleHash, lazy.RootHash())
+
+	value, found, err := lazy.Get([]byte("0500"))
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("value 500"), value)
+	require.Less(t, counting.stats["get"], 100)
+	require.LessOrEqual(t, cache.Len(), 16)
+
+	for _, m := range generateSorted(1000) {
+		value, found, err := lazy.Get(m.key)
+		require.Nil(t, err)
+		require.True(t, found)
+		require.Equal(t, m.value, value)
+	}
+	_, found, err = lazy.Get([]byte("05000"))
+	require.Nil(t, err)
+	require.False(t, found)
+
+	for _, c := range [][2]string{{"", ""}, {"0100", "0200"}, {"00995", "0500"}, {"0990", ""}, {"2000", ""}} {
+		start, end := []byte(c[0]), []byte(c[1])
+		it := lazy.Range(start, end)
+		require.Equal(t, collectRange(tree.Range(start, end), false), collectLazyRange(it, false), c)
+		require.Nil(t, it.Err())
+		require.Equal(t, collectRange(tree.Range(start, end), true), collectLazyRange(it, true), c)
+		require.Nil(t, it.Err())
+	}
+
+	it := lazy.Range(nil, nil)
+	require.True(t, it.Seek([]byte("0300")))
+	require.True(t, it.Prev())
+	require.Equal(t, []byte("0299"), it.Key())
+	require.Equal(t, []byte("value 299"), it.Value())
+}
+
+func TestLazyTreeMissingNode(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	lazy := NewLazyTree(kv, Hash{1}, nil)
+	_, _, err := lazy.Get([]byte("1"))
+	require.ErrorIs(t, err, ErrNodeMissing)
+	it := lazy.Range(nil, nil)
+	require.False(t, it.First())
+	require.ErrorIs(t, it.Err(), ErrNodeMissing)
+	_, err = OpenLazyTree(1, kv, nil)
+	require.ErrorIs(t, err, ErrNodeMissing)
+
+	// a nil cache still caches
+	require.Nil(t, NewTree(generate1(10), nil).SerializeWithKids(1, kv))
+	lazy, err = OpenLazyTree(1, kv, nil)
+	require.Nil(t, err)
+	value, found, err := lazy.Get([]byte("5"))
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("value 5"), value)
+	require.Positive(t, lazy.cache.Len())
+}
+
+func collectLazyRange(it *LazyRangeIter, reverse bool) (keys []string) {
+	if reverse {
+		for ok := it.Last(); ok; ok = it.Prev() {
+			keys = append(keys, string(it.Key()))
+		}
+		return keys
+	}
+	for ok := it.First(); ok; ok = it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func mapOf(messages []*Message) map[string]string {
+	out := map[string]string{}
+	for _, m := range messages {
+		out[string(m.key)] = string(m.value)
+	}
+	return out
+}
+
+func mapDiff(source, target map[string]string) DeltaTrio {
+	out := DeltaTrio{Add: []Delta{}, Remove: []Delta{}, Update: []Delta{}}
+	for k, v := range target {
+		if old, found := source[k]; !found {
+			out.Add = append(out.Add, Delta{key: []byte(k), typ: "add", target: []byte(v)})
+		} else if old != v {
+			out.Update = append(out.Update, Delta{key: []byte(k), typ: "update", source: []byte(old), target: []byte(v)})
+		}
+	}
+	for k, v := range source {
+		if _, found := target[k]; !found {
+			out.Remove = append(out.Remove, Delta{key: []byte(k), typ: "remove", source: []byte(v)})
+		}
+	}
+	return sortDeltas(out)
+}
+
+func sortDeltas(d DeltaTrio) DeltaTrio {
+	for _, ds := range [][]Delta{d.Add, d.Remove, d.Update} {
+		slices.SortFunc(ds, func(a, b Delta) int { return bytes.Compare(a.key, b.key) })
+	}
+	return d
+}
+
+func requireSameDeltas(t *testing.T, want, got DeltaTrio) {
+	got = sortDeltas(got)
+	require.Equal(t, want.Add, got.Add)
+	require.Equal(t, want.Remove, got.Remove)
+	require.Equal(t, want.Update, got.Update)
+}
+
+func TestDiffStored(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	rnd := rand.New(rand.NewPCG(5, 6))
+	base := mapOf(generateSorted(1000))
+	require.Nil(t, NewTree(messagesOf(base), nil).SerializeWithKids(0, kv))
+	for gen := 1; gen < 6; gen++ {
+		next := maps.Clone(base)
+		for range rnd.IntN(10 * gen) {
+			key := fmt.Sprintf("%04d", rnd.IntN(1200))
+			switch rnd.IntN(3) {
+			case 0:
+				delete(next, key)
+			default:
+				next[key] = fmt.Sprintf("gen %d", gen)
+			}
+		}
+		require.Nil(t, NewTree(messagesOf(next), nil).SerializeWithKids(gen, kv))
+		counting := NewCountingKV(kv)
+		d, err := DiffStored(counting, 0, gen)
+		require.Nil(t, err)
+		requireSameDeltas(t, mapDiff(base, next), d)
+	}
+
+	one := maps.Clone(base)
+	one["0042"] = "changed"
+	require.Nil(t, NewTree(messagesOf(one), nil).SerializeWithKids(100, kv))
+	counting := NewCountingKV(kv)
+	d, err := DiffStored(counting, 0, 100)
+	require.Nil(t, err)
+	require.Len(t, d.Update, 1)
+	require.Len(t, d.Add, 0)
+	require.Len(t, d.Remove, 0)
+	require.Less(t, counting.stats["get"], 100)
+
+	d, err = DiffStored(kv, 100, 100)
+	require.Nil(t, err)
+	requireSameDeltas(t, DeltaTrio{Add: []Delta{}, Remove: []Delta{}, Update: []Delta{}}, d)
+	require.Equal(t, d.SourceRoot, d.TargetRoot)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Version is the state of a key on one side of a merge.
+type Version struct {
+	Value  []byte
+	Exists bool
+}
+
+// Conflict describes a key that ours and theirs changed in different ways.
+type Conflict struct {
+	Key    []byte
+	Base   Version
+	Ours   Version
+	Theirs Version
+}
+
+// Resolver picks the merged state of a conflicting key. Returning a Version
+// with Exists=false deletes the key from the merged tree.
+type Resolver func(c Conflict) (Version, error)
+
+var ErrConflict = errors.New("merge conflict")
+
+func ResolveOurs(c Conflict) (Version, error)   { return c.Ours, nil }
+func ResolveTheirs(c Conflict) (Version, error) { return c.Theirs, nil }
+
+// ResolveFail aborts the merge on the first conflict.
+func ResolveFail(c Conflict) (Version, error) {
+	return Version{}, fmt.Errorf("%w: key %q", ErrConflict, c.Key)
+}
+
+// LastWriterWins prefers the side that was written later. On a tie the larger
+// value wins, so that every replica reaches the same result.
+func LastWriterWins(oursTime time.Time, theirsTime time.Time) Resolver {
+	return func(c Conflict) (Version, error) {
+		switch {
+		case oursTime.After(theirsTime):
+			return c.Ours, nil
+		case theirsTime.After(oursTime):
+			return c.Theirs, nil
+		case !c.Ours.Exists:
+			return c.Theirs, nil
+		case !c.Theirs.Exists:
+			return c.Ours, nil
+		case bytes.Compare(c.Ours.Value, c.Theirs.Value) >= 0:
+			return c.Ours, nil
+		default:
+			return c.Theirs, nil
+		}
+	}
+}
+
+// Merge combines the changes that ours and theirs made relative to their
+// common ancestor base. Changes to different keys, and identical changes to
+// the same key, are applied as is; everything else goes through resolve, one
+// key at a time in key order. None of the input trees is modified.
+func Merge(base, ours, theirs *Tree, resolve Resolver) (*Tree, error) {
+	oursChanges := changesOf(Diff(base, ours))
+	theirsChanges := changesOf(Diff(base, theirs))
+
+	batch := NewBatch()
+	add := func(key []byte, v Version) {
+		if v.Exists {
+			batch.Put(key, v.Value)
+		} else {
+			batch.Delete(key)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(oursChanges)) {
+		o := oursChanges[k]
+		t, both := theirsChanges[k]
+		if !both {
+			add(o.key, o.target)
+			continue
+		}
+		if o.target.equal(t.target) {
+			add(o.key, o.target)
+			continue
+		}
+		v, err := resolve(Conflict{Key: o.key, Base: o.source, Ours: o.target, Theirs: t.target})
+		if err != nil {
+			return nil, err
+		}
+		add(o.key, v)
+	}
+	for k, t := range theirsChanges {
+		if _, both := oursChanges[k]; !both {
+			add(t.key, t.target)
+		}
+	}
+
+	merged := base.Clone()
+	merged.Apply(batch)
+	return merged, nil
+}
+
+func (v Version) equal(o Version) bool {
+	return v.Exists == o.Exists && bytes.Equal(v.Value, o.Value)
+}
+
+type change struct {
+	key    []byte
+	source Version
+	target Version
+}
+
+// changesOf indexes the deltas by key; map keys are the key bytes as a string.
+func changesOf(d DeltaTrio) map[string]change {
+	out := map[string]change{}
+	for _, delta := range d.Add {
+		out[string(delta.key)] = change{key: delta.key, target: Version{Value: delta.target, Exists: true}}
+	}
+	for _, delta := range d.Update {
+		out[string(delta.key)] = change{key: delta.key, source: Version{Value: delta.source, Exists: true}, target: Version{Value: delta.target, Exists: true}}
+	}
+	for _, delta := range d.Remove {
+		out[string(delta.key)] = change{key: delta.key, source: Version{Value: delta.source, Exists: true}}
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	base := mapOf(generateSorted(200))
+	ours := maps.Clone(base)
+	theirs := maps.Clone(base)
+
+	ours["0010"] = "ours"   // changed only by us
+	delete(ours, "0020")    // removed only by us
+	ours["1000"] = "ours"   // added only by us
+	theirs["0030"] = "them" // changed only by them
+	delete(theirs, "0040")  // removed only by them
+	theirs["2000"] = "them" // added only by them
+	ours["0050"] = "same"   // identical change on both sides
+	theirs["0050"] = "same"
+	delete(ours, "0060") // identical removal on both sides
+	delete(theirs, "0060")
+	ours["0070"] = "ours" // conflicting updates
+	theirs["0070"] = "them"
+	delete(ours, "0080") // removed by us, updated by them
+	theirs["0080"] = "them"
+	ours["3000"] = "ours" // conflicting additions
+	theirs["3000"] = "them"
+
+	baseTree := NewTree(messagesOf(base), nil)
+	oursTree := NewTree(messagesOf(ours), nil)
+	theirsTree := NewTree(messagesOf(theirs), nil)
+	baseRoot := baseTree.Root().merkleHash
+
+	expected := maps.Clone(base)
+	for _, k := range []string{"0010", "1000"} {
+		expected[k] = ours[k]
+	}
+	for _, k := range []string{"0030", "2000"} {
+		expected[k] = theirs[k]
+	}
+	expected["0050"] = "same"
+	for _, k := range []string{"0020", "0040", "0060"} {
+		delete(expected, k)
+	}
+
+	withOurs := maps.Clone(expected)
+	withOurs["0070"] = "ours"
+	delete(withOurs, "0080")
+	withOurs["3000"] = "ours"
+	merged, err := Merge(baseTree, oursTree, theirsTree, ResolveOurs)
+	require.Nil(t, err)
+	requireSameTree(t, withOurs, merged)
+
+	withTheirs := maps.Clone(expected)
+	withTheirs["0070"] = "them"
+	withTheirs["0080"] = "them"
+	withTheirs["3000"] = "them"
+	merged, err = Merge(baseTree, oursTree, theirsTree, ResolveTheirs)
+	require.Nil(t, err)
+	requireSameTree(t, withTheirs, merged)
+
+	now := time.Now()
+	merged, err = Merge(baseTree, oursTree, theirsTree, LastWriterWins(now, now.Add(time.Second)))
+	require.Nil(t, err)
+	requireSameTree(t, withTheirs, merged)
+
+	var conflicts []Conflict
+	custom := func(c Conflict) (Version, error) {
+		conflicts = append(conflicts, c)
+		return Version{Value: slices.Concat(c.Ours.Value, []byte("+"), c.Theirs.Value), Exists: true}, nil
+	}
+	merged, err = Merge(baseTree, oursTree, theirsTree, custom)
+	require.Nil(t, err)
+	require.Len(t, conflicts, 3)
+	for i, key := range []string{"0070", "0080", "3000"} {
+		require.Equal(t, []byte(key), conflicts[i].Key)
+	}
+	value, found := merged.Get([]byte("0080"))
+	require.True(t, found)
+	require.Equal(t, []byte("+them"), value)
+
+	// the first conflict in key order fails the merge, every time
+	for range 20 {
+		_, err = Merge(baseTree, oursTree, theirsTree, ResolveFail)
+		require.ErrorIs(t, err, ErrConflict)
+		require.Contains(t, err.Error(), `"0070"`)
+	}
+
+	require.Equal(t, baseRoot, baseTree.Root().merkleHash)
+	requireSameTree(t, base, baseTree)
+}
+
+func TestLastWriterWinsTie(t *testing.T) {
+	now := time.Now()
+	lww := LastWriterWins(now, now)
+	c := Conflict{Key: []byte("k"), Ours: Version{Value: []byte("a"), Exists: true}, Theirs: Version{Value: []byte("b"), Exists: true}}
+	v, err := lww(c)
+	require.Nil(t, err)
+	require.Equal(t, []byte("b"), v.Value)
+	c.Theirs = Version{}
+	v, err = lww(c)
+	require.Nil(t, err)
+	require.Equal(t, []byte("a"), v.Value)
+}
@@ -0,0 +1,75 @@
+package main
+
+import "bytes"
+
+// RangeIter streams the level0 entries of a tree whose keys fall into
+// [start, end) in ascending or descending order. An empty end means the range
+// is unbounded on the right. The iterator is positioned via the upper levels,
+// so Seek, First and Last cost O(height + bucket size).
+//
+//	it := tree.Range([]byte("2024-01"), []byte("2024-02"))
+//	for ok := it.First(); ok; ok = it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+type RangeIter struct {
+	tree  *Tree
+	start []byte
+	end   []byte
+	p     *Node
+}
+
+func (t *Tree) Range(start []byte, end []byte) *RangeIter {
+	return &RangeIter{tree: t, start: start, end: end}
+}
+
+// Seek positions the iterator at the first entry with a key greater than or
+// equal to key.
+func (it *RangeIter) Seek(key []byte) bool {
+	if bytes.Compare(key, it.start) < 0 {
+		key = it.start
+	}
+	return it.set(it.tree.seek(key))
+}
+
+// First positions the iterator at the smallest key of the range.
+func (it *RangeIter) First() bool { return it.Seek(it.start) }
+
+// Last positions the iterator at the largest key of the range.
+func (it *RangeIter) Last() bool {
+	if len(it.end) == 0 {
+		return it.set(it.tree.levels[0].tail.left)
+	}
+	return it.set(it.tree.seek(it.end).left)
+}
+
+func (it *RangeIter) Next() bool {
+	if it.p == nil {
+		return false
+	}
+	return it.set(it.p.right)
+}
+
+func (it *RangeIter) Prev() bool {
+	if it.p == nil {
+		return false
+	}
+	return it.set(it.p.left)
+}
+
+func (it *RangeIter) Valid() bool   { return it.p != nil }
+func (it *RangeIter) Key() []byte   { return it.p.key }
+func (it *RangeIter) Value() []byte { return it.p.value }
+
+func (it *RangeIter) set(p *Node) bool {
+	if p == nil || p.isTail || !inRange(p.key, it.start, it.end) {
+		it.p = nil
+		return false
+	}
+	it.p = p
+	return true
+}
+
+// inRange reports whether start <= key < end, an empty end being unbounded.
+func inRange(key []byte, start []byte, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (len(end) == 0 || bytes.Compare(key, end) < 0)
+}
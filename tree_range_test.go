@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func generateSorted(n int) []*Message {
+	m := []*Message{}
+	for i := range n {
+		m = append(m, NewMessage([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	return m
+}
+
+func collectRange(it *RangeIter, reverse bool) (keys []string) {
+	if reverse {
+		for ok := it.Last(); ok; ok = it.Prev() {
+			keys = append(keys, string(it.Key()))
+		}
+		return keys
+	}
+	for ok := it.First(); ok; ok = it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func TestRange(t *testing.T) {
+	tree := NewTree(generateSorted(300), nil)
+	keysBetween := func(from, to int) (keys []string) {
+		for i := from; i < to; i++ {
+			keys = append(keys, fmt.Sprintf("%04d", i))
+		}
+		return keys
+	}
+
+	cases := []struct {
+		start, end string
+		from, to   int
+	}{
+		{"", "", 0, 300},
+		{"0010", "0020", 10, 20},
+		{"0010", "00195", 10, 20},
+		{"00095", "0020", 10, 20},
+		{"0290", "", 290, 300},
+		{"0100", "0100", 0, 0},
+		{"0500", "", 0, 0},
+	}
+	for _, c := range cases {
+		want := keysBetween(c.from, c.to)
+		require.Equal(t, want, collectRange(tree.Range([]byte(c.start), []byte(c.end)), false), c)
+		slices.Reverse(want)
+		require.Equal(t, want, collectRange(tree.Range([]byte(c.start), []byte(c.end)), true), c)
+	}
+
+	it := tree.Range([]byte("0100"), []byte("0200"))
+	require.True(t, it.Seek([]byte("0150")))
+	require.Equal(t, []byte("0150"), it.Key())
+	require.Equal(t, []byte("value 150"), it.Value())
+	require.True(t, it.Prev())
+	require.Equal(t, []byte("0149"), it.Key())
+	require.True(t, it.Seek([]byte("0000")))
+	require.Equal(t, []byte("0100"), it.Key())
+	require.False(t, it.Prev())
+	require.False(t, it.Valid())
+	require.False(t, it.Seek([]byte("0200")))
+
+	require.Empty(t, collectRange(NewTree(nil, nil).Range(nil, nil), false))
+}
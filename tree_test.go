@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"testing"
 
@@ -16,7 +18,7 @@ func generate1(n int) []*Message {
 	for i := range n {
 		i := i + 1
 		data := fmt.Sprintf("value %d", i)
-		m = append(m, &Message{timestamp: strconv.Itoa(i), data: data})
+		m = append(m, &Message{key: []byte(strconv.Itoa(i)), value: []byte(data)})
 	}
 	return m
 }
@@ -26,7 +28,7 @@ func generate2(n int) []*Message {
 	for i := range n {
 		i := i + 1
 		data := fmt.Sprintf("value2 %d", i)
-		m = append(m, &Message{timestamp: strconv.Itoa(i), data: data})
+		m = append(m, &Message{key: []byte(strconv.Itoa(i)), value: []byte(data)})
 	}
 	return m
 }
@@ -35,7 +37,7 @@ func TestBuild(t *testing.T) {
 	messages := generate1(10)
 	kv := NewKVFile()
 	kv.MustReset()
-	tree := NewTree(messages)
+	tree := NewTree(messages, nil)
 	fmt.Println(tree)
 	// mustNil(tree.Build(files))
 }
@@ -43,11 +45,11 @@ func TestBuild(t *testing.T) {
 func TestDiffSimple(t *testing.T) {
 	// {
 	// 	all := generate(20)
-	// 	t := NewTree(all)
+	// 	t := NewTree(all, nil)
 	// 	t.Dot("all.dot")
-	// 	t1 := NewTree(all)
-	// 	// t2 := NewTree(slices.Delete(slices.Delete(all, 3, 4), 14, 15))
-	// 	t2 := NewTree(slices.Delete(slices.Delete(all, 3, 18), 0, 1))
+	// 	t1 := NewTree(all, nil)
+	// 	// t2 := NewTree(slices.Delete(slices.Delete(all, 3, 4), 14, 15), nil)
+	// 	t2 := NewTree(slices.Delete(slices.Delete(all, 3, 18), 0, 1), nil)
 	// 	t1.Dot("t1.dot")
 	// 	t2.Dot("t2.dot")
 	// 	fmt.Println(t2)
@@ -57,49 +59,49 @@ func TestDiffSimple(t *testing.T) {
 	// }
 
 	{
-		t1 := NewTree(generate1(2))
-		t2 := NewTree(generate1(3))
+		t1 := NewTree(generate1(2), nil)
+		t2 := NewTree(generate1(3), nil)
 		t1.Dot("t1.dot")
 		t2.Dot("t2.dot")
 		require.Len(t, Diff(t1, t2).Add, 1)
 	}
 	{
-		t1 := NewTree(generate1(1))
-		t2 := NewTree(generate1(51))
+		t1 := NewTree(generate1(1), nil)
+		t2 := NewTree(generate1(51), nil)
 		require.Len(t, Diff(t1, t2).Add, 50)
 	}
 	{
-		t1 := NewTree(generate1(30)[10:])
-		t2 := NewTree(generate1(30))
+		t1 := NewTree(generate1(30)[10:], nil)
+		t2 := NewTree(generate1(30), nil)
 		require.Len(t, Diff(t1, t2).Add, 10)
 	}
 	{
-		t1 := NewTree(generate1(30)[:20])
-		t2 := NewTree(generate1(30))
+		t1 := NewTree(generate1(30)[:20], nil)
+		t2 := NewTree(generate1(30), nil)
 		require.Len(t, Diff(t1, t2).Add, 10)
 	}
 	{
-		t1 := NewTree(generate1(30)[10:20])
-		t2 := NewTree(generate1(30))
+		t1 := NewTree(generate1(30)[10:20], nil)
+		t2 := NewTree(generate1(30), nil)
 		require.Len(t, Diff(t1, t2).Add, 20)
 	}
 	{
 		g := generate1(100)
-		t1 := NewTree(append(g[:10], append(g[20:30], append(g[40:50], append(g[60:70], g[80:90]...)...)...)...))
-		t2 := NewTree(generate1(100))
+		t1 := NewTree(append(g[:10], append(g[20:30], append(g[40:50], append(g[60:70], g[80:90]...)...)...)...), nil)
+		t2 := NewTree(generate1(100), nil)
 		require.Len(t, Diff(t1, t2).Add, 50)
 	}
 	{
-		t1 := NewTree(generate1(10))
-		t2 := NewTree(generate2(10))
+		t1 := NewTree(generate1(10), nil)
+		t2 := NewTree(generate2(10), nil)
 		d := Diff(t1, t2)
 		require.Len(t, d.Add, 0)
 		require.Len(t, d.Update, 10)
 		require.Len(t, d.Remove, 0)
 	}
 	{
-		t1 := NewTree(generate1(20))
-		t2 := NewTree(generate2(30)[10:])
+		t1 := NewTree(generate1(20), nil)
+		t2 := NewTree(generate2(30)[10:], nil)
 		d := Diff(t1, t2)
 		require.Len(t, d.Add, 10)
 		require.Len(t, d.Update, 10)
@@ -110,6 +112,21 @@ func TestDiffSimple(t *testing.T) {
 	// mustNil(tree.Build(files))
 }
 
+func TestGet(t *testing.T) {
+	tree := NewTree(generate1(500), nil)
+	for _, m := range generate1(500) {
+		value, found := tree.Get(m.key)
+		require.True(t, found)
+		require.Equal(t, m.value, value)
+	}
+	for _, key := range []string{"", "0", "5000", "99a", "<TAIL>"} {
+		_, found := tree.Get([]byte(key))
+		require.False(t, found, key)
+	}
+	_, found := NewTree(nil, nil).Get([]byte("1"))
+	require.False(t, found)
+}
+
 func pickN(xs []*Message, n int) []*Message {
 	rand.Shuffle(len(xs), func(i, j int) {
 		xs[i], xs[j] = xs[j], xs[i]
@@ -134,14 +151,14 @@ func ListBasedDiff(a, b []*Message) (out DeltaTrio) {
 	mapA := make(map[string]*Message)
 	mapB := make(map[string]*Message)
 	for _, msg := range a {
-		mapA[msg.timestamp] = msg
+		mapA[string(msg.key)] = msg
 	}
 	for _, msg := range b {
-		mapB[msg.timestamp] = msg
+		mapB[string(msg.key)] = msg
 	}
 	for ts, msgB := range mapB {
 		if msgA, exists := mapA[ts]; exists {
-			if msgA.data != msgB.data {
+			if !bytes.Equal(msgA.value, msgB.value) {
 				out.Update = append(out.Update, Delta{})
 			}
 		} else {
@@ -157,7 +174,7 @@ func ListBasedDiff(a, b []*Message) (out DeltaTrio) {
 }
 
 func TestSerializeLevel0(t *testing.T) {
-	t1 := NewTree(generate1(10))
+	t1 := NewTree(generate1(10), nil)
 	kv := NewKVFile()
 	kv.MustReset()
 	require.Nil(t, t1.SerializeLevel0(kv))
@@ -170,7 +187,7 @@ func TestSerializeLevel0(t *testing.T) {
 }
 
 func TestSerializeWithKids(t *testing.T) {
-	t1 := NewTree(generate1(10))
+	t1 := NewTree(generate1(10), nil)
 	kv := NewKVFile()
 	kv.MustReset()
 	gen := 42
@@ -183,8 +200,68 @@ func TestSerializeWithKids(t *testing.T) {
 	require.Len(t, d.Remove, 0)
 }
 
+func TestDeserializeWithKidsVerified(t *testing.T) {
+	tree := NewTree(generate1(100), withChunker(FanoutChunker(4)))
+	kv := NewKVFile()
+	kv.MustReset()
+	require.Nil(t, tree.SerializeWithKids(7, kv))
+	loaded, err := DeserializeWithKidsVerified(7, kv)
+	require.Nil(t, err)
+	require.Equal(t, tree.Root().merkleHash, loaded.Root().merkleHash)
+	_, err = DeserializeWithKidsVerified(8, kv)
+	require.ErrorIs(t, err, ErrNodeMissing)
+	_, err = DeserializeWithKids(8, kv)
+	require.ErrorIs(t, err, ErrNodeMissing)
+
+	rewrite := func(n *Node, change func([]byte) []byte) (restore func()) {
+		value, found, err := kv.Get(n.KeyWithKids())
+		require.Nil(t, err)
+		require.True(t, found)
+		require.Nil(t, kv.Set(n.KeyWithKids(), change(slices.Clone(value))))
+		return func() { require.Nil(t, kv.Set(n.KeyWithKids(), value)) }
+	}
+	requireIntegrityError := func(n *Node) *IntegrityError {
+		_, err := DeserializeWithKidsVerified(7, kv)
+		var integrity *IntegrityError
+		require.ErrorAs(t, err, &integrity)
+		require.Equal(t, 7, integrity.Gen)
+		require.Equal(t, n.merkleHash, integrity.Hash)
+		return integrity
+	}
+
+	// a partially written leaf
+	leaf := tree.levels[0].tail.left.left
+	restoreLeaf := rewrite(leaf, func(b []byte) []byte { return b[:len(b)-2] })
+	_, err = DeserializeWithKids(7, kv)
+	require.ErrorIs(t, err, ErrConfigMismatch)
+	integrity := requireIntegrityError(leaf)
+	require.Equal(t, int8(0), integrity.Level)
+	require.NotEqual(t, integrity.Hash, integrity.Computed)
+
+	// kids in the wrong order; the leaf below is reported first
+	upper := tree.levels[1].tail
+	require.Greater(t, len(upper.ListKids()), 1)
+	restoreUpper := rewrite(upper, func(b []byte) []byte {
+		kids := b[len(b)-2*HashSize:]
+		copy(kids, append(slices.Clone(kids[HashSize:]), kids[:HashSize]...))
+		return b
+	})
+	requireIntegrityError(leaf)
+	restoreLeaf()
+	require.Equal(t, int8(1), requireIntegrityError(upper).Level)
+	restoreUpper()
+
+	// a node that doesn't decode
+	restore := rewrite(upper, func(b []byte) []byte { return b[:5] })
+	require.ErrorIs(t, requireIntegrityError(upper), ErrNodeFormat)
+	restore()
+
+	_, err = DeserializeWithKidsVerified(7, kv)
+	require.Nil(t, err)
+}
+
 func TestSerializeJSON(t *testing.T) {
-	t1 := NewTree(generate1(10))
+	t1 := NewTree(generate1(10), nil)
 	kv := NewKVFile()
 	kv.MustReset()
 	gen := 42
@@ -218,7 +295,7 @@ func TestSizeSerializeJSON(t *testing.T) {
 	kv := NewKVFile()
 	kv.MustReset()
 	for gen := range 1000 {
-		t1 := NewTree(generate1(gen))
+		t1 := NewTree(generate1(gen), nil)
 		file, err := os.Create(filepath.Join(kv.dir, fmt.Sprintf("gen-%d.json", gen)))
 		require.Nil(t, err)
 		defer file.Close()
@@ -231,11 +308,63 @@ func TestSizeSerializeWithKids(t *testing.T) {
 	if os.Getenv("SIZE") == "" {
 		t.Skipf("set SIZE=1 to run this test")
 	}
+	// one series per chunker, so that plot.py can compare them
+	for _, chunker := range []Chunker{DefaultChunker, FanoutChunker(32), NewCDFChunker(10)} {
+		kv := NewKVFile()
+		kv.MustReset()
+		for gen := range 1000 {
+			t1 := NewTree(generate1(gen), withChunker(chunker))
+			require.Nil(t, t1.SerializeWithKids(gen, kv))
+			fmt.Printf("%d,prolly-%s,%d,%d\n", gen, chunker.Name(), MustDirSize(kv.dir), t1.Height())
+		}
+	}
+}
+
+func TestBinaryEntries(t *testing.T) {
+	entries := map[string]string{
+		"":         "empty key",
+		"\x00":     "\x00\x01\x02",
+		"\xff\xfe": "",
+		"<TAIL>":   "not the tail",
+		"a\nb":     "\xff",
+	}
+	tree := NewTree(messagesOf(entries), nil)
+	for k, v := range entries {
+		value, found := tree.Get([]byte(k))
+		require.True(t, found, "%q", k)
+		require.Equal(t, []byte(v), value)
+	}
+
 	kv := NewKVFile()
 	kv.MustReset()
-	for gen := range 1000 {
-		t1 := NewTree(generate1(gen))
-		require.Nil(t, t1.SerializeWithKids(gen, kv))
-		fmt.Printf("%d,prolly,%d,%d\n", gen, MustDirSize(kv.dir), t1.Height())
+	require.Nil(t, tree.SerializeWithKids(1, kv))
+	loaded, err := DeserializeWithKids(1, kv)
+	require.Nil(t, err)
+	require.Equal(t, tree.Root().merkleHash, loaded.Root().merkleHash)
+	lazy, err := OpenLazyTree(1, kv, NewNodeCache(DefaultNodeCacheSize))
+	require.Nil(t, err)
+	for k, v := range entries {
+		value, found, err := lazy.Get([]byte(k))
+		require.Nil(t, err)
+		require.True(t, found, "%q", k)
+		require.Equal(t, []byte(v), value)
 	}
+
+	// moving bytes between key and value changes the hash
+	ab := NewTree([]*Message{NewMessage([]byte("ab"), []byte("c"))}, nil)
+	bc := NewTree([]*Message{NewMessage([]byte("a"), []byte("bc"))}, nil)
+	require.NotEqual(t, ab.Root().merkleHash, bc.Root().merkleHash)
+}
+
+// A long key is stored like any other.
+func TestSerializeLongKey(t *testing.T) {
+	kv := NewKVFile()
+	kv.MustReset()
+	messages := generate1(100)
+	messages[0].key = bytes.Repeat([]byte("k"), 100000)
+	tree := NewTree(messages, nil)
+	require.Nil(t, tree.SerializeWithKids(1, kv))
+	loaded, err := DeserializeWithKidsVerified(1, kv)
+	require.Nil(t, err)
+	require.Equal(t, tree.Root().merkleHash, loaded.Root().merkleHash)
 }